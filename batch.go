@@ -0,0 +1,50 @@
+package kuda
+
+import "context"
+
+// BatchCall is a request sent in a batch and its outcome.
+type BatchCall struct {
+	Method string
+	Params any
+
+	// Response is the response to the request, and Err is set if the
+	// request failed. Both are set by Client.Batch.
+	Response *JsonRpcResponse
+	Err      error
+}
+
+// Batch sends the calls as one JSON-RPC batch, which takes a single message
+// each way instead of one per call. The outcome of each call is stored in
+// it. The returned error is set only if the batch couldn't be sent or
+// answered at all.
+func (c *Client) Batch(calls []*BatchCall) error {
+	if len(calls) == 0 {
+		return nil
+	}
+
+	ids := make([]any, len(calls))
+	requests := make([]*JsonRpcRequest, len(calls))
+	for i, call := range calls {
+		ids[i] = c.nextID()
+		requests[i] = &JsonRpcRequest{
+			Method:  call.Method,
+			Params:  call.Params,
+			Id:      ids[i],
+			Version: "2.0",
+		}
+	}
+
+	resps, err := c.roundTrip(context.Background(), requests, ids)
+	if err != nil {
+		for _, call := range calls {
+			call.Response, call.Err = nil, err
+		}
+		return err
+	}
+
+	for i, call := range calls {
+		call.Response = findResponse(resps, ids[i])
+		call.Err = checkResponse(call.Response)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package kuda
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// failHandler answers the method Echo.Fail with an error and echoes the
+// params of other methods.
+func failHandler(t *testing.T) http.Handler {
+	echo := echoHandler(t)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string          `json:"method"`
+			Id     json.RawMessage `json:"id"`
+		}
+		body := readBody(t, r)
+		json.Unmarshal(body, &req)
+		if req.Method != "Echo.Fail" {
+			echo.ServeHTTP(w, withBody(r, body))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":   JsonRpcError{Code: -32000, Message: "failed"},
+			"id":      req.Id,
+			"jsonrpc": "2.0",
+		})
+	})
+}
+
+func TestClient_Batch(t *testing.T) {
+	for _, dial := range []bool{false, true} {
+		serverPort, clientPort, _ := servePipe(&Server{}, failHandler(t))
+
+		client := &Client{Dialer: clientPort.Dialer}
+		if dial {
+			if err := client.Dial(); err != nil {
+				t.Fatalf("Dial was failed: %v", err)
+			}
+		}
+
+		calls := []*BatchCall{
+			{Method: "Echo.Echo", Params: []string{"first"}},
+			{Method: "Echo.Fail", Params: []string{"second"}},
+			{Method: "Echo.Echo", Params: []string{"third"}},
+		}
+		if err := client.Batch(calls); err != nil {
+			t.Fatalf("Batch was failed: %v", err)
+		}
+
+		for i, want := range []string{"first", "", "third"} {
+			call := calls[i]
+			if want == "" {
+				if call.Err == nil {
+					t.Errorf("Error response of call %d was not reported", i)
+				}
+				continue
+			}
+
+			var result []string
+			if call.Err != nil {
+				t.Errorf("Call %d was failed: %v", i, call.Err)
+			} else if err := call.Response.GetObject(&result); err != nil {
+				t.Errorf("GetObject was failed: %v", err)
+			} else if len(result) != 1 || result[0] != want {
+				t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{want}, result)
+			}
+		}
+
+		client.Close()
+		serverPort.Close()
+	}
+}
+
+func TestServer_emptyBatch(t *testing.T) {
+	serverPort, clientPort, _ := servePipe(&Server{}, echoHandler(t))
+	defer serverPort.Close()
+	if err := clientPort.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer clientPort.Close()
+
+	if _, err := clientPort.Write([]byte("[]")); err != nil {
+		t.Fatalf("Write was failed: %v", err)
+	}
+	packet, err := clientPort.ReadPacket()
+	if err != nil {
+		t.Fatalf("Read was failed: %v", err)
+	}
+
+	resps, err := decodeResponse(packet)
+	if err != nil {
+		t.Fatalf("decodeResponse was failed: %v", err)
+	}
+	if len(resps) != 1 || resps[0].Error.Code != -32600 || resps[0].Id != nil {
+		t.Errorf("Response is not match\nwant: %v\ngot:  %+v", "Invalid Request with null id", resps[0])
+	}
+}
@@ -0,0 +1,76 @@
+package kuda
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Checksum selects the integrity check which is appended to every frame.
+type Checksum byte
+
+const (
+	// CRC32 appends an IEEE CRC-32 to every frame. This is the default.
+	CRC32 Checksum = iota
+	// CRC16 appends a CRC-16/CCITT-FALSE to every frame. It is cheaper on
+	// slow links at the cost of weaker error detection.
+	CRC16
+)
+
+func (c Checksum) size() int {
+	if c == CRC16 {
+		return 2
+	}
+	return 4
+}
+
+func (c Checksum) flag() byte {
+	if c == CRC16 {
+		return flagCRC16
+	}
+	return 0
+}
+
+func (c Checksum) append(b []byte, data []byte) []byte {
+	if c == CRC16 {
+		return binary.BigEndian.AppendUint16(b, crc16(data))
+	}
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(data))
+}
+
+func (c Checksum) verify(data []byte, sum []byte) bool {
+	if c == CRC16 {
+		return binary.BigEndian.Uint16(sum) == crc16(data)
+	}
+	return binary.BigEndian.Uint32(sum) == crc32.ChecksumIEEE(data)
+}
+
+func checksumOf(flags byte) Checksum {
+	if flags&flagCRC16 != 0 {
+		return CRC16
+	}
+	return CRC32
+}
+
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 calculates CRC-16/CCITT-FALSE (poly 0x1021, init 0xFFFF).
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
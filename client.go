@@ -2,83 +2,761 @@ package kuda
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.bug.st/serial"
 )
 
-type JsonRpcError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-}
-
 type JsonRpcRequest struct {
-	Method  string `json:"method"`
-	Params  any    `json:"params"`
-	Id      int    `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+	// Id is either a number or a string. It is nil for notifications.
+	Id      any    `json:"id,omitempty"`
 	Version string `json:"jsonrpc"`
 }
 
 type JsonRpcResponse struct {
-	Result  *json.RawMessage `json:"result"`
-	Id      int              `json:"id"`
-	Version string           `json:"jsonrpc"`
-	Error   JsonRpcError     `json:"error"`
+	Result *json.RawMessage `json:"result"`
+	// Id is the id of the request, decoded as json.Number or string.
+	Id      any          `json:"id"`
+	Version string       `json:"jsonrpc"`
+	Error   JsonRpcError `json:"error"`
+
+	// Status and Header are the status code and the headers of the
+	// response envelope. Status is zero if the response had no envelope.
+	Status int         `json:"-"`
+	Header http.Header `json:"-"`
+
+	// statusErr is set instead of Error if the body of the envelope wasn't
+	// a JSON-RPC response.
+	statusErr *StatusError
 }
 
+// lastID is the id of the last request sent by any Client.
+var lastID atomic.Int64
+
+// sameID reports whether two ids are equal in JSON.
+func sameID(a, b any) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// GetObject decodes the result into data. A null or missing result leaves
+// data unchanged.
 func (response *JsonRpcResponse) GetObject(data any) error {
+	if response.Result == nil {
+		return nil
+	}
 	return json.Unmarshal(*response.Result, data)
 }
 
 type Client struct {
 	PortName string
 	BaudRate int
+
+	// Dialer opens the transport instead of the serial port PortName.
+	Dialer func() (Transport, error)
+	// Port holds the settings of the link, such as the full serial Mode,
+	// WriteSize, Retry and ReadTimeout. It is copied whenever the port is
+	// opened. If set, PortName, BaudRate and Dialer are ignored.
+	Port *Kuda
+	// NextID returns the id of the next request, e.g. to use string ids.
+	// It must not return the same id twice. If nil, ids are numbers
+	// counting up.
+	NextID func() any
+	// Path makes every request carry an envelope like an HTTP POST to
+	// Path with Header, so that the server can route it, e.g. with
+	// http.ServeMux. The Content-Type is application/json unless Header
+	// says otherwise. If empty, bare JSON-RPC messages are sent.
+	Path   string
+	Header http.Header
+
+	// mutex guards the fields below. conn is set between Dial and Close.
+	mutex sync.Mutex
+	conn  *clientConn
+	// closed is closed when the port left to a cancelled call, which
+	// finishes sending its request, has been closed. The next call doesn't
+	// open the port before.
+	closed chan struct{}
 }
 
-func (c *Client) Call(method string, params any) (*JsonRpcResponse, error) {
-	port := &Kuda{
+// clientConn is the link kept open between Dial and Close.
+type clientConn struct {
+	newPort func() *Kuda
+	// decode returns the keys of the requests a message answers, and the
+	// result passed to their call. No keys stand for an error which can't
+	// be related to a request.
+	decode func(packet *bytes.Buffer) ([]string, callResult, error)
+
+	mutex   sync.Mutex
+	session *session
+	// closed is set by close. The port isn't opened again after it.
+	closed bool
+}
+
+// session is an opened port with the goroutine which reads its responses
+// and hands them to the calls waiting for them.
+type session struct {
+	port   *Kuda
+	decode func(packet *bytes.Buffer) ([]string, callResult, error)
+
+	mutex sync.Mutex
+	// calls maps the JSON encoded ids of the pending requests to the calls.
+	// The requests of a batch share one call.
+	calls map[string]*pendingCall
+	// err is set when the reader has stopped.
+	err  error
+	done chan struct{}
+}
+
+// pendingCall waits for the message answering one or more requests.
+type pendingCall struct {
+	keys   []string
+	result chan callResult
+}
+
+type callResult struct {
+	resps []*JsonRpcResponse
+	// resp is set instead of resps for a RoundTripper.
+	resp *http.Response
+	err  error
+}
+
+func (c *Client) newPort() *Kuda {
+	if c.Port != nil {
+		return c.Port.clone()
+	}
+
+	return &Kuda{
 		PortName: c.PortName,
 		Mode: &serial.Mode{
 			BaudRate: c.BaudRate,
 		},
+		Dialer: c.Dialer,
 	}
+}
 
-	if err := port.Open(); err != nil {
-		return nil, fmt.Errorf("[client] serial port couldn't be opened: %w", err)
+// Dial opens the port and keeps it open for the following calls until
+// Close is called. If the port vanishes, it is reopened by the next call.
+// Without Dial, every call opens and closes the port by itself.
+//
+// Calls on a dialed Client may be made from many goroutines at once. Their
+// requests are sent over the same link, and each response is passed to the
+// call with the matching id.
+func (c *Client) Dial() error {
+	conn := &clientConn{newPort: c.newPort, decode: decodeCall}
+	s, err := conn.open()
+	if err != nil {
+		return fmt.Errorf("[client] serial port couldn't be opened: %w", err)
 	}
-	defer port.Close()
 
-	rcpReq := &JsonRpcRequest{
+	conn.session = s
+	c.mutex.Lock()
+	c.conn = conn
+	c.mutex.Unlock()
+	return nil
+}
+
+// Close closes the port opened by Dial. Pending calls fail.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mutex.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.close()
+}
+
+func (c *Client) Call(method string, params any) (*JsonRpcResponse, error) {
+	return c.CallContext(context.Background(), method, params)
+}
+
+// CallContext is like Call but gives up when ctx is done. The link stays
+// usable: a request which is still being sent is completed in the
+// background, and the late response is discarded.
+func (c *Client) CallContext(ctx context.Context, method string, params any) (*JsonRpcResponse, error) {
+	id := c.nextID()
+	request := &JsonRpcRequest{
 		Method:  method,
 		Params:  params,
-		Id:      0,
+		Id:      id,
 		Version: "2.0",
 	}
 
-	outbuf := &bytes.Buffer{}
-	enc := json.NewEncoder(outbuf)
-	if err := enc.Encode(rcpReq); err != nil {
+	resps, err := c.roundTrip(ctx, request, []any{id})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := findResponse(resps, id)
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Notify sends a notification, a request without an id. The server sends
+// no response to it, so Notify returns as soon as the peer has acknowledged
+// the message.
+func (c *Client) Notify(method string, params any) error {
+	request := &JsonRpcRequest{
+		Method:  method,
+		Params:  params,
+		Version: "2.0",
+	}
+
+	_, err := c.roundTrip(context.Background(), request, nil)
+	return err
+}
+
+func (c *Client) nextID() any {
+	if c.NextID != nil {
+		return c.NextID()
+	}
+	return lastID.Add(1)
+}
+
+// Invoke calls method with args and returns the decoded result. A null or
+// missing result is returned as the zero value of Result.
+func Invoke[Args, Result any](ctx context.Context, client *Client, method string, args Args) (Result, error) {
+	var result Result
+	response, err := client.CallContext(ctx, method, args)
+	if err != nil {
+		return result, err
+	}
+
+	if err := response.GetObject(&result); err != nil {
+		return result, fmt.Errorf("[client] decode error: %w", err)
+	}
+	return result, nil
+}
+
+// roundTrip sends a message holding the requests with ids and returns the
+// responses of the message answering them. Without ids the message is a
+// notification, and roundTrip returns once it has been delivered.
+func (c *Client) roundTrip(ctx context.Context, message any, ids []any) ([]*JsonRpcResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("[client] call was cancelled: %w", err)
+	}
+
+	data, err := c.encode(message, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	conn, closed := c.conn, c.closed
+	c.mutex.Unlock()
+	if conn != nil {
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			key, err := json.Marshal(id)
+			if err != nil {
+				return nil, fmt.Errorf("[client] encode error: %w", err)
+			}
+			keys[i] = string(key)
+		}
+
+		result, err := conn.roundTrip(ctx, data, keys)
+		return result.resps, err
+	}
+
+	if closed != nil {
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("[client] call was cancelled: %w", ctx.Err())
+		}
+	}
+	port := c.newPort()
+	if err := port.Open(); err != nil {
+		return nil, fmt.Errorf("[client] serial port couldn't be opened: %w", err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendRequest(port, data)
+	}()
+	select {
+	case err := <-sent:
+		if err != nil || len(ids) == 0 {
+			port.Close()
+			return nil, err
+		}
+	case <-ctx.Done():
+		// Stopping in the middle of the message would leave the peer
+		// with a partial one, so it is sent to the end before the port is
+		// closed.
+		closed := make(chan struct{})
+		c.mutex.Lock()
+		c.closed = closed
+		c.mutex.Unlock()
+		go func() {
+			<-sent
+			port.Close()
+			close(closed)
+		}()
+		return nil, fmt.Errorf("[client] call was cancelled: %w", ctx.Err())
+	}
+	// Closing the port stops the goroutine below if ctx is done first.
+	defer port.Close()
+
+	done := make(chan callResult, 1)
+	go func() {
+		resps, err := receiveResponse(port, ids)
+		done <- callResult{resps: resps, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.resps, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("[client] call was cancelled: %w", ctx.Err())
+	}
+}
+
+// encode encodes a message, in an envelope if Path is set.
+func (c *Client) encode(message any, ids []any) ([]byte, error) {
+	out := &bytes.Buffer{}
+	if err := json.NewEncoder(out).Encode(message); err != nil {
 		return nil, fmt.Errorf("[client] encode error: %w", err)
 	}
+	if c.Path == "" {
+		return out.Bytes(), nil
+	}
+
+	header := c.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	if len(ids) > 0 {
+		id, err := json.Marshal(ids[0])
+		if err != nil {
+			return nil, fmt.Errorf("[client] encode error: %w", err)
+		}
+		header.Set(idHeader, string(id))
+	}
+	if isBatch(out.Bytes()) {
+		header.Set(batchHeader, "1")
+	}
+	return requestEnvelope(http.MethodPost, c.Path, header, out.Bytes()), nil
+}
+
+func (conn *clientConn) open() (*session, error) {
+	port := conn.newPort()
+	if err := port.Open(); err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		port:   port,
+		decode: conn.decode,
+		calls:  make(map[string]*pendingCall),
+		done:   make(chan struct{}),
+	}
+	go s.read()
+	return s, nil
+}
+
+// current returns the session, opening the port if it isn't open or has
+// gone.
+func (conn *clientConn) current() (*session, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return nil, fmt.Errorf("[client] link was closed: %w", ErrPortClosed)
+	}
+	if conn.session != nil && !conn.session.stopped() {
+		return conn.session, nil
+	}
+
+	if conn.session != nil {
+		conn.session.close()
+	}
+	s, err := conn.open()
+	if err != nil {
+		return nil, fmt.Errorf("[client] serial port couldn't be reopened: %w", err)
+	}
+	conn.session = s
+	return s, nil
+}
+
+// close closes the port. Pending and later calls fail.
+func (conn *clientConn) close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.closed = true
+	s := conn.session
+	if s == nil {
+		return nil
+	}
+	conn.session = nil
+	return s.close()
+}
+
+// roundTrip sends a message holding the requests with the encoded keys and
+// returns the result of the message answering them.
+func (conn *clientConn) roundTrip(ctx context.Context, message []byte, keys []string) (callResult, error) {
+	type sent struct {
+		s    *session
+		call *pendingCall
+		err  error
+	}
+	done := make(chan sent, 1)
+	go func() {
+		s, call, err := conn.send(message, keys)
+		done <- sent{s, call, err}
+	}()
+
+	var r sent
+	select {
+	case r = <-done:
+		if r.err != nil {
+			return callResult{}, r.err
+		}
+	case <-ctx.Done():
+		// Stopping in the middle of the message would leave the peer
+		// with a partial one, so it is sent to the end.
+		go func() {
+			if r := <-done; r.err == nil {
+				r.s.unregister(r.call)
+			}
+		}()
+		return callResult{}, fmt.Errorf("[client] call was cancelled: %w", ctx.Err())
+	}
+
+	if len(keys) == 0 {
+		return callResult{}, nil
+	}
+	// Each call waits for its response up to ReadTimeout, like ReadPacket
+	// of a port which isn't kept open.
+	var timeout <-chan time.Time
+	if d := r.s.port.ReadTimeout; d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result := <-r.call.result:
+		return result, result.err
+	case <-timeout:
+		r.s.unregister(r.call)
+		return callResult{}, fmt.Errorf("[client] reading buffer was failed: %w", ErrTimeout)
+	case <-ctx.Done():
+		r.s.unregister(r.call)
+		return callResult{}, fmt.Errorf("[client] call was cancelled: %w", ctx.Err())
+	}
+}
+
+// send registers a call for the requests with the encoded keys and sends
+// the message. The message is sent again over the reopened port if the
+// port has gone.
+func (conn *clientConn) send(message []byte, keys []string) (*session, *pendingCall, error) {
+	for attempt := 1; ; attempt++ {
+		s, err := conn.current()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		call, err := s.register(keys)
+		if err == nil {
+			err = sendRequest(s.port, message)
+			if err == nil {
+				return s, call, nil
+			}
+			s.unregister(call)
+		}
+
+		// The request can't have been handled, so it is safe to send it
+		// again over the reopened port.
+		if !isPortError(err) || attempt > 1 {
+			return nil, nil, err
+		}
+		s.port.Close()
+		<-s.done
+	}
+}
+
+// register adds a pending call for the requests with the encoded ids.
+func (s *session) register(keys []string) (*pendingCall, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	for _, key := range keys {
+		if _, ok := s.calls[key]; ok {
+			return nil, fmt.Errorf("[client] request id %s is already in use", key)
+		}
+	}
+
+	call := &pendingCall{
+		keys:   keys,
+		result: make(chan callResult, 1),
+	}
+	for _, key := range keys {
+		s.calls[key] = call
+	}
+	return call, nil
+}
+
+func (s *session) unregister(call *pendingCall) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range call.keys {
+		delete(s.calls, key)
+	}
+}
+
+// stopped reports whether the reader has stopped because of a port error.
+func (s *session) stopped() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err != nil
+}
+
+func (s *session) close() error {
+	broken := s.stopped()
+	err := s.port.Close()
+	<-s.done
+	if broken {
+		// the port has already gone
+		return nil
+	}
+	return err
+}
+
+// read passes responses to the pending calls until the port fails.
+func (s *session) read() {
+	defer close(s.done)
+
+	for {
+		packet, err := s.port.ReadPacket()
+		if err != nil && isPortError(err) {
+			s.stop(fmt.Errorf("[client] reading buffer was failed: %w", err))
+			return
+		}
+		if errors.Is(err, ErrTimeout) {
+			// calls wait for their responses by their own timeouts
+			continue
+		}
+		if err != nil {
+			log.Printf("[client] reading buffer was failed: %v", err)
+			continue
+		}
+
+		keys, result, err := s.decode(packet)
+		if err != nil {
+			log.Printf("[client] %v", err)
+			continue
+		}
+
+		if call := s.take(keys); call != nil {
+			call.result <- result
+		} else {
+			log.Printf("[client] response to another request (id: %v) has been discarded", keys)
+		}
+	}
+}
+
+// take removes and returns the call a message with the keys belongs to.
+func (s *session) take(keys []string) *pendingCall {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var call *pendingCall
+	for _, key := range keys {
+		if c, ok := s.calls[key]; ok {
+			call = c
+			break
+		}
+	}
+	if call == nil && len(keys) == 0 {
+		// The server answers with a null id if it couldn't read the id,
+		// which can only be attributed if one call is pending.
+		calls := map[*pendingCall]bool{}
+		for _, c := range s.calls {
+			calls[c] = true
+			call = c
+		}
+		if len(calls) != 1 {
+			call = nil
+		}
+	}
+	if call == nil {
+		return nil
+	}
+
+	for _, key := range call.keys {
+		delete(s.calls, key)
+	}
+	return call
+}
+
+// stop fails all pending calls.
+func (s *session) stop(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+	for key, call := range s.calls {
+		select {
+		case call.result <- callResult{err: err}:
+		default:
+			// another request of the batch has been failed already
+		}
+		delete(s.calls, key)
+	}
+}
 
-	if _, err := port.Write(outbuf.Bytes()); err != nil {
-		return nil, fmt.Errorf("[client] write error: %w", err)
+func sendRequest(port *Kuda, message []byte) error {
+	if _, err := port.Write(message); err != nil {
+		return fmt.Errorf("[client] write error: %w", err)
 	}
 
-	if packet, err := port.ReadPacket(); err != nil {
-		return nil, fmt.Errorf("[client] reading buffer was failed: %w", err)
+	return nil
+}
+
+// receiveResponse reads messages until the message answering the requests
+// with ids arrives. Responses to other requests, e.g. late replies to calls
+// which have failed before, are discarded.
+func receiveResponse(port *Kuda, ids []any) ([]*JsonRpcResponse, error) {
+	for {
+		packet, err := port.ReadPacket()
+		if err != nil {
+			return nil, fmt.Errorf("[client] reading buffer was failed: %w", err)
+		}
+
+		resps, err := decodeResponse(packet)
+		if err != nil {
+			return nil, fmt.Errorf("[client] %w", err)
+		}
+
+		for _, resp := range resps {
+			for _, id := range ids {
+				if sameID(resp.Id, id) {
+					return resps, nil
+				}
+			}
+		}
+		// The server answers with a null id if it couldn't read the id.
+		if isNullIDError(resps) {
+			return resps, nil
+		}
+
+		log.Printf("[client] response to another request (id: %v) has been discarded", resps[0].Id)
+	}
+}
+
+// decodeCall decodes the responses to calls for a session.
+func decodeCall(packet *bytes.Buffer) ([]string, callResult, error) {
+	resps, err := decodeResponse(packet)
+	if err != nil {
+		return nil, callResult{}, err
+	}
+
+	var keys []string
+	if !isNullIDError(resps) {
+		for _, resp := range resps {
+			if key, err := json.Marshal(resp.Id); err == nil {
+				keys = append(keys, string(key))
+			}
+		}
+	}
+	return keys, callResult{resps: resps}, nil
+}
+
+// decodeResponse decodes a response or the responses of a batch, which may
+// come in an envelope.
+func decodeResponse(packet *bytes.Buffer) ([]*JsonRpcResponse, error) {
+	if hasEnvelope(packet.Bytes()) {
+		return decodeEnvelope(packet.Bytes())
+	}
+	return decodeMessage(packet.Bytes())
+}
+
+// decodeMessage decodes a bare response or the responses of a batch.
+func decodeMessage(message []byte) ([]*JsonRpcResponse, error) {
+	dec := json.NewDecoder(bytes.NewReader(message))
+	dec.UseNumber()
+
+	var resps []*JsonRpcResponse
+	if isBatch(message) {
+		if err := dec.Decode(&resps); err != nil {
+			return nil, fmt.Errorf("decode error: %w", err)
+		}
 	} else {
 		var resp JsonRpcResponse
-		dec := json.NewDecoder(packet)
 		if err := dec.Decode(&resp); err != nil {
-			return nil, fmt.Errorf("[client] decode error: %w", err)
+			return nil, fmt.Errorf("decode error: %w", err)
 		}
+		resps = append(resps, &resp)
+	}
 
-		if resp.Error.Code != 0 {
-			return nil, fmt.Errorf("[client] error response has been received: %d : %s", resp.Error.Code, resp.Error.Message)
+	if len(resps) == 0 {
+		return nil, fmt.Errorf("decode error: empty batch")
+	}
+	return resps, nil
+}
+
+// isBatch reports whether a JSON message is an array.
+func isBatch(message []byte) bool {
+	trimmed := bytes.TrimLeft(message, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+func isNullIDError(resps []*JsonRpcResponse) bool {
+	return len(resps) == 1 && resps[0].Id == nil && (resps[0].Error.isSet() || resps[0].statusErr != nil)
+}
+
+// findResponse returns the response to the request id, or the error the
+// server sent with a null id.
+func findResponse(resps []*JsonRpcResponse, id any) *JsonRpcResponse {
+	for _, resp := range resps {
+		if sameID(resp.Id, id) {
+			return resp
 		}
+	}
+	if isNullIDError(resps) {
+		return resps[0]
+	}
+	return nil
+}
 
-		return &resp, nil
+func checkResponse(resp *JsonRpcResponse) error {
+	if resp == nil {
+		return fmt.Errorf("[client] no response has been received")
+	}
+	if resp.statusErr != nil {
+		return fmt.Errorf("[client] error status has been received: %w", resp.statusErr)
+	}
+	if resp.Error.isSet() {
+		err := resp.Error
+		return fmt.Errorf("[client] error response has been received: %w", &err)
 	}
+	return nil
 }
@@ -0,0 +1,426 @@
+package kuda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func callEcho(t *testing.T, client *Client, param string) {
+	t.Helper()
+
+	response, err := client.Call("Echo.Echo", []string{param})
+	if err != nil {
+		t.Errorf("Call was failed: %v", err)
+		return
+	}
+
+	var result []string
+	if err := response.GetObject(&result); err != nil {
+		t.Errorf("GetObject was failed: %v", err)
+	} else if len(result) != 1 || result[0] != param {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{param}, result)
+	}
+}
+
+func TestClient_Dial(t *testing.T) {
+	serverPort, clientPort, _ := servePipe(&Server{}, echoHandler(t))
+	defer serverPort.Close()
+
+	var transports []Transport
+	client := &Client{
+		Dialer: func() (Transport, error) {
+			transport, err := clientPort.Dialer()
+			transports = append(transports, transport)
+			return transport, err
+		},
+	}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	callEcho(t, client, "first")
+	callEcho(t, client, "second")
+	if len(transports) != 1 {
+		t.Errorf("Port was opened %d times", len(transports))
+	}
+
+	// the port vanishes
+	transports[0].Close()
+
+	callEcho(t, client, "third")
+	if len(transports) != 2 {
+		t.Errorf("Port was not reopened (opened %d times)", len(transports))
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	release := make(chan struct{})
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		if bytes.Contains(body, []byte(`"slow"`)) {
+			<-release
+		}
+		echo.ServeHTTP(w, withBody(r, body))
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	conn := client.conn
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.Call("Echo.Echo", []string{"slow"})
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Close(); err != nil {
+		t.Errorf("Close was failed: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Call error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	release <- struct{}{}
+
+	// a call which took the link before Close doesn't open it again
+	if _, err := conn.roundTrip(context.Background(), []byte(`{}`), []string{"1"}); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Call error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	if conn.session != nil {
+		t.Errorf("Port was opened again after Close")
+	}
+}
+
+func TestClient_stringID(t *testing.T) {
+	serverPort, clientPort, _ := servePipe(&Server{}, echoHandler(t))
+	defer serverPort.Close()
+
+	n := 0
+	client := &Client{
+		Dialer: clientPort.Dialer,
+		NextID: func() any {
+			n++
+			return fmt.Sprintf("req-%d", n)
+		},
+	}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Call("Echo.Echo", []string{"test"})
+	if err != nil {
+		t.Fatalf("Call was failed: %v", err)
+	}
+	if response.Id != "req-1" {
+		t.Errorf("Id is not match\nwant: %v\ngot:  %v", "req-1", response.Id)
+	}
+}
+
+func TestClient_discardOtherResponse(t *testing.T) {
+	serverPort, clientPort := Pipe()
+	if err := serverPort.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer serverPort.Close()
+
+	client := &Client{
+		Dialer: clientPort.Dialer,
+		NextID: func() any { return 7 },
+	}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	go func() {
+		if _, err := serverPort.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		}
+		serverPort.Write([]byte(`{"result":"late","id":6,"jsonrpc":"2.0"}`))
+		serverPort.Write([]byte(`{"result":"current","id":7,"jsonrpc":"2.0"}`))
+	}()
+
+	response, err := client.Call("Echo.Echo", nil)
+	if err != nil {
+		t.Fatalf("Call was failed: %v", err)
+	}
+
+	var result string
+	if err := response.GetObject(&result); err != nil {
+		t.Errorf("GetObject was failed: %v", err)
+	} else if result != "current" {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", "current", result)
+	}
+}
+
+func TestClient_concurrent(t *testing.T) {
+	serverPort, clientPort, _ := servePipe(&Server{MaxConcurrent: 4}, echoHandler(t))
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			callEcho(t, client, fmt.Sprintf("call-%d", i))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClient_outOfOrder(t *testing.T) {
+	slowStarted := make(chan struct{})
+	fastDone := make(chan struct{})
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		var req struct {
+			Params []string `json:"params"`
+		}
+		json.Unmarshal(body, &req)
+
+		r = withBody(r, body)
+		if req.Params[0] == "slow" {
+			// answered only after the later request
+			close(slowStarted)
+			<-fastDone
+			echo.ServeHTTP(w, r)
+			return
+		}
+		echo.ServeHTTP(w, r)
+		close(fastDone)
+	})
+	serverPort, clientPort, _ := servePipe(&Server{MaxConcurrent: 2}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		callEcho(t, client, "slow")
+	}()
+
+	<-slowStarted
+	callEcho(t, client, "fast")
+	<-slow
+}
+
+func TestClient_Notify(t *testing.T) {
+	received := make(chan map[string]json.RawMessage, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]json.RawMessage
+		json.Unmarshal(readBody(t, r), &req)
+		received <- req
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Notify("Log.Write", []string{"test"}); err != nil {
+		t.Fatalf("Notify was failed: %v", err)
+	}
+
+	req := <-received
+	if _, ok := req["id"]; ok {
+		t.Errorf("Notification has an id: %s", req["id"])
+	}
+	if string(req["method"]) != `"Log.Write"` {
+		t.Errorf("Method is not match\nwant: %v\ngot:  %s", `"Log.Write"`, req["method"])
+	}
+}
+
+func TestClient_CallContext(t *testing.T) {
+	release := make(chan struct{})
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		if bytes.Contains(body, []byte(`"slow"`)) {
+			<-release
+		}
+		echo.ServeHTTP(w, withBody(r, body))
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	for _, dial := range []bool{true, false} {
+		client := &Client{Dialer: clientPort.Dialer}
+		if dial {
+			if err := client.Dial(); err != nil {
+				t.Fatalf("Dial was failed: %v", err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err := client.CallContext(ctx, "Echo.Echo", []string{"slow"})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Error is not match\nwant: %v\ngot:  %v", context.DeadlineExceeded, err)
+		}
+
+		// the late response must not be taken for the next one
+		release <- struct{}{}
+		callEcho(t, client, "next")
+		client.Close()
+	}
+}
+
+func TestClient_cancelWhileSending(t *testing.T) {
+	received := make(chan []byte, 4)
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		received <- body
+		echo.ServeHTTP(w, withBody(r, body))
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	big := string(bytes.Repeat([]byte{'a'}, 256*1024))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	_, err := client.CallContext(ctx, "Echo.Echo", []string{big})
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error is not match\nwant: %v\ngot:  %v", context.DeadlineExceeded, err)
+	}
+	callEcho(t, client, "next")
+
+	// the cancelled request has been sent to the end, so it doesn't
+	// garble the next one
+	for _, want := range []string{big, "next"} {
+		var req struct {
+			Params []string `json:"params"`
+		}
+		if err := json.Unmarshal(<-received, &req); err != nil {
+			t.Errorf("Request is broken: %v", err)
+		} else if len(req.Params) != 1 || req.Params[0] != want {
+			t.Errorf("Request params are not match (want: %d bytes, got: %d bytes)", len(want), len(strings.Join(req.Params, "")))
+		}
+	}
+}
+
+func TestClient_cancelWhileWaitingForPort(t *testing.T) {
+	// nobody answers, so a request is sent until the retries run out
+	_, clientPort := Pipe()
+	clientPort.Retry = RetryPolicy{MaxAttempts: 1, ACKTimeout: time.Second}
+	client := &Client{Port: clientPort}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err := client.CallContext(ctx, "Echo.Echo", []string{"first"})
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error is not match\nwant: %v\ngot:  %v", context.DeadlineExceeded, err)
+	}
+
+	// the next call waits for the port, but not beyond its context
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = client.CallContext(ctx, "Echo.Echo", []string{"second"})
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error is not match\nwant: %v\ngot:  %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Call returned after its context was done: %v", elapsed)
+	}
+}
+
+func TestClient_ReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		if bytes.Contains(body, []byte(`"slow"`)) {
+			<-release
+		}
+		echo.ServeHTTP(w, withBody(r, body))
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+	clientPort.ReadTimeout = 100 * time.Millisecond
+
+	// each call of a dialed Client waits for its response up to ReadTimeout
+	client := &Client{Port: clientPort}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	_, err := client.Call("Echo.Echo", []string{"slow"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Error is not match\nwant: %v\ngot:  %v", ErrTimeout, err)
+	}
+
+	release <- struct{}{}
+	callEcho(t, client, "next")
+}
+
+func TestInvoke(t *testing.T) {
+	serverPort, clientPort, _ := servePipe(&Server{}, echoHandler(t))
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	result, err := Invoke[[]string, []string](context.Background(), client, "Echo.Echo", []string{"test"})
+	if err != nil {
+		t.Errorf("Invoke was failed: %v", err)
+	} else if len(result) != 1 || result[0] != "test" {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{"test"}, result)
+	}
+
+	// the params null are echoed as the result null
+	empty, err := Invoke[any, *struct{ Name string }](context.Background(), client, "Echo.Echo", nil)
+	if err != nil {
+		t.Errorf("Invoke was failed: %v", err)
+	} else if empty != nil {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", nil, empty)
+	}
+}
+
+func TestGetObject_missingResult(t *testing.T) {
+	var resp JsonRpcResponse
+	if err := json.Unmarshal([]byte(`{"id":1,"jsonrpc":"2.0"}`), &resp); err != nil {
+		t.Fatalf("Unmarshal was failed: %v", err)
+	}
+
+	result := "unchanged"
+	if err := resp.GetObject(&result); err != nil {
+		t.Errorf("GetObject was failed: %v", err)
+	} else if result != "unchanged" {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", "unchanged", result)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -17,15 +18,10 @@ type (
 	}
 )
 
-func CalculatorAdd(client kuda.Client) {
+func CalculatorAdd(client *kuda.Client) {
 	added := 10
 	add := 12
-	response, err := client.Call("Calculator.Add", &AdditionArgs{Added: added, Add: add})
-	if err != nil {
-		log.Fatalln(err)
-	}
-	var result AdditionResult
-	err = response.GetObject(&result) // (2)
+	result, err := kuda.Invoke[*AdditionArgs, AdditionResult](context.Background(), client, "Calculator.Add", &AdditionArgs{Added: added, Add: add})
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -47,13 +43,8 @@ type (
 	}
 )
 
-func FileTransferDownload(client kuda.Client) {
-	response, err := client.Call("FileTransfer.Download", &FileTransferArgs{Name: "main.go"})
-	if err != nil {
-		log.Fatalln(err)
-	}
-	var result FileTransferReply
-	err = response.GetObject(&result)
+func FileTransferDownload(client *kuda.Client) {
+	result, err := kuda.Invoke[*FileTransferArgs, FileTransferReply](context.Background(), client, "FileTransfer.Download", &FileTransferArgs{Name: "main.go"})
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -64,18 +55,13 @@ func FileTransferDownload(client kuda.Client) {
 	}
 }
 
-func FileTransferUpload(client kuda.Client) {
+func FileTransferUpload(client *kuda.Client) {
 	data, err := os.ReadFile("main.go")
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	response, err := client.Call("FileTransfer.Upload", &FileTransferUploadArgs{Name: "main.go", Data: data})
-	if err != nil {
-		log.Fatalln(err)
-	}
-	var result FileTransferReply
-	err = response.GetObject(&result)
+	_, err = kuda.Invoke[*FileTransferUploadArgs, FileTransferReply](context.Background(), client, "FileTransfer.Upload", &FileTransferUploadArgs{Name: "main.go", Data: data})
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -85,9 +71,13 @@ func main() {
 	portname := flag.String("port", "COM1", "port name")
 	flag.Parse()
 
-	client := kuda.Client{
+	client := &kuda.Client{
 		PortName: *portname,
 	}
+	if err := client.Dial(); err != nil {
+		log.Fatalln(err)
+	}
+	defer client.Close()
 
 	// CalculatorAdd(client)
 	FileTransferUpload(client)
@@ -0,0 +1,279 @@
+package kuda
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dial opens port and returns it as a net.Conn, so that stream protocols
+// such as HTTP or net/rpc can run over the link. Closing the Conn closes
+// the port.
+//
+// Each Write is sent as a message and Read returns the received messages
+// as one stream, so the bytes arrive complete and in order. Read deadlines
+// interrupt a waiting Read. A Write which has begun is completed by the
+// RetryPolicy of the port regardless of the write deadline. The link has no
+// notion of closing: the peer isn't told when the Conn is closed, and a
+// peer which opens its port again continues the same stream.
+func Dial(port *Kuda) (net.Conn, error) {
+	if err := port.Open(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: addr(port.PortName), Err: err}
+	}
+	return newConn(port, port.Close), nil
+}
+
+// Listen opens port and returns a listener for the peer at the other end,
+// e.g. to serve it with http.Server. As the link connects to one peer only,
+// Accept returns one Conn over the port at a time. The next Conn is
+// returned when the previous one has been closed, and carries on with the
+// stream. Closing the listener closes the port.
+func Listen(port *Kuda) (net.Listener, error) {
+	if err := port.Open(); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: addr(port.PortName), Err: err}
+	}
+
+	l := &listener{
+		port:   port,
+		free:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	l.free <- struct{}{}
+	return l, nil
+}
+
+// network is the name of the network of the addresses of a link.
+const network = "kuda"
+
+// addr is the address of either end of a link, which is the port name.
+type addr string
+
+func (a addr) Network() string { return network }
+func (a addr) String() string  { return string(a) }
+
+type listener struct {
+	port *Kuda
+	// free holds a token while no Conn is open.
+	free      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.free:
+	case <-l.closed:
+		return nil, l.opError(net.ErrClosed)
+	}
+
+	if isClosed(l.closed) {
+		l.free <- struct{}{}
+		return nil, l.opError(net.ErrClosed)
+	}
+	select {
+	case <-l.port.done:
+		// Conns over a failed port would fail at once.
+		l.free <- struct{}{}
+		return nil, l.opError(l.port.rxErr)
+	default:
+	}
+
+	return newConn(l.port, func() error {
+		l.free <- struct{}{}
+		return nil
+	}), nil
+}
+
+func (l *listener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.port.Close()
+	})
+	return err
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr(l.port.PortName)
+}
+
+func (l *listener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: network, Addr: l.Addr(), Err: err}
+}
+
+// conn is a net.Conn over an opened link.
+type conn struct {
+	port *Kuda
+	// release is called by the first Close.
+	release func() error
+	closed  atomic.Bool
+
+	// readMutex serializes reads. rest is what is left of the last
+	// message.
+	readMutex     sync.Mutex
+	rest          []byte
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+func newConn(port *Kuda, release func() error) *conn {
+	return &conn{
+		port:          port,
+		release:       release,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.rest) == 0 {
+		if c.closed.Load() {
+			return 0, c.opError("read", net.ErrClosed)
+		}
+
+		packet, err := c.port.readPacket(c.readDeadline.wait())
+		if errors.Is(err, errReadCancelled) {
+			if c.closed.Load() {
+				return 0, c.opError("read", net.ErrClosed)
+			}
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		if errors.Is(err, ErrTimeout) {
+			// the deadlines stand for ReadTimeout
+			continue
+		}
+		if err != nil {
+			return 0, c.opError("read", err)
+		}
+		c.rest = packet.Bytes()
+	}
+
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, c.opError("write", net.ErrClosed)
+	}
+	select {
+	case <-c.writeDeadline.wait():
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	default:
+	}
+
+	n, err := c.port.Write(p)
+	if err != nil {
+		return n, c.opError("write", err)
+	}
+	return n, nil
+}
+
+// Close closes the conn and interrupts a waiting Read. Messages which
+// haven't been read yet stay queued for the next Conn of a listener.
+func (c *conn) Close() error {
+	if c.closed.Swap(true) {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.readDeadline.set(time.Unix(1, 0))
+	return c.release()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return addr(c.port.PortName)
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return addr(c.port.PortName)
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.closed.Load() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if c.closed.Load() {
+		return c.opError("set", net.ErrClosed)
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: network, Addr: c.RemoteAddr(), Err: err}
+}
+
+// deadline is a channel closed when the deadline passes.
+type deadline struct {
+	mutex  sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer has fired, wait for it to close the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() || time.Until(t) > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		if !t.IsZero() {
+			cancel := d.cancel
+			d.timer = time.AfterFunc(time.Until(t), func() {
+				close(cancel)
+			})
+		}
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns the channel closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
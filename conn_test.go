@@ -0,0 +1,172 @@
+package kuda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListen_httpServer(t *testing.T) {
+	serverPort, clientPort := Pipe()
+	l, err := Listen(serverPort)
+	if err != nil {
+		t.Fatalf("Listen was failed: %v", err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+		}),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+
+	conn, err := Dial(clientPort)
+	if err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	dialed := false
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if dialed {
+					return nil, errors.New("the link has been dialed already")
+				}
+				dialed = true
+				return conn, nil
+			},
+		},
+	}
+
+	// both requests go over the same connection
+	for _, path := range []string{"/first", "/second"} {
+		resp, err := client.Get("http://device" + path)
+		if err != nil {
+			t.Fatalf("Get was failed: %v", err)
+		}
+		if body := readResponse(t, resp); body != "GET "+path {
+			t.Errorf("Body is not match\nwant: %v\ngot:  %v", "GET "+path, body)
+		}
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown was failed: %v", err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("Serve error is not match\nwant: %v\ngot:  %v", http.ErrServerClosed, err)
+	}
+	conn.Close()
+}
+
+func TestConn_deadline(t *testing.T) {
+	a, b := Pipe()
+	conn, err := Dial(a)
+	if err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer conn.Close()
+	if err := b.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer b.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read error is not match\nwant: %v\ngot:  %v", os.ErrDeadlineExceeded, err)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read error is not a timeout: %v", err)
+	}
+
+	// messages are read as a stream
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		b.Write([]byte("hello, "))
+		b.Write([]byte("world"))
+	}()
+	got := make([]byte, 0, 12)
+	buf := make([]byte, 4)
+	for len(got) < len("hello, world") {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read was failed: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "hello, world", got)
+	}
+
+	// a past deadline fails Write before anything is sent
+	conn.SetWriteDeadline(time.Unix(1, 0))
+	if _, err := conn.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write error is not match\nwant: %v\ngot:  %v", os.ErrDeadlineExceeded, err)
+	}
+}
+
+func TestListener_Accept(t *testing.T) {
+	serverPort, clientPort := Pipe()
+	l, err := Listen(serverPort)
+	if err != nil {
+		t.Fatalf("Listen was failed: %v", err)
+	}
+	if err := clientPort.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer clientPort.Close()
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept was failed: %v", err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept was failed: %v", err)
+		}
+		accepted <- conn
+	}()
+	select {
+	case <-accepted:
+		t.Fatalf("Accept returned while a Conn is open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// closing interrupts a waiting Read
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := first.Read(make([]byte, 16))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	first.Close()
+	if err := <-readErr; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read error is not match\nwant: %v\ngot:  %v", net.ErrClosed, err)
+	}
+
+	// the next Conn carries on with the stream
+	second := <-accepted
+	go clientPort.Write([]byte("test"))
+	buf := make([]byte, 16)
+	if n, err := second.Read(buf); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if string(buf[:n]) != "test" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "test", buf[:n])
+	}
+
+	second.Close()
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept error is not match\nwant: %v\ngot:  %v", net.ErrClosed, err)
+	}
+}
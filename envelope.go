@@ -0,0 +1,141 @@
+package kuda
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// An envelope is the head of an HTTP/1.1 request or response put in front
+// of a message, so that the method, path and headers of a request and the
+// status and headers of its response travel with it. A bare JSON-RPC
+// message begins with '{' or '[', while an envelope begins with a method
+// or "HTTP/", so both can be told apart by the first byte.
+
+// idHeader carries an id of an enveloped request which is to be answered,
+// e.g. the JSON encoded id of the first JSON-RPC request in it. The server
+// copies it into the response envelope, so that the client can match
+// responses which aren't JSON-RPC, e.g. a 404 of http.ServeMux.
+const idHeader = "Kuda-Id"
+
+// batchHeader marks an enveloped message as a JSON-RPC batch, which the
+// server splits into its requests. Other bodies are passed on as they are.
+const batchHeader = "Kuda-Batch"
+
+// StatusError is the error of a call answered with an HTTP status other
+// than 2xx and a body which isn't a JSON-RPC response, e.g. a 404 of
+// http.ServeMux for an unknown path. It can be taken out with errors.As.
+type StatusError struct {
+	// StatusCode and Status are those of the response envelope, e.g. 404
+	// and "404 Not Found".
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP status error: %s", e.Status)
+}
+
+// hasEnvelope reports whether a message begins with an envelope.
+func hasEnvelope(message []byte) bool {
+	trimmed := bytes.TrimLeft(message, " \t\r\n")
+	return len(trimmed) > 0 && 'A' <= trimmed[0] && trimmed[0] <= 'Z'
+}
+
+// requestEnvelope puts the head of a request for uri in front of body.
+func requestEnvelope(method, uri string, header http.Header, body []byte) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "%s %s HTTP/1.1\r\n", method, uri)
+	header.WriteSubset(out, map[string]bool{"Content-Length": true})
+	fmt.Fprintf(out, "Content-Length: %d\r\n\r\n", len(body))
+	out.Write(body)
+	return out.Bytes()
+}
+
+// openRequest splits a message into its request envelope and the body. A
+// message without an envelope is returned as the body of a nil request.
+func openRequest(message []byte) (*http.Request, []byte, error) {
+	if !hasEnvelope(message) {
+		return nil, message, nil
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(message)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading envelope was failed: %w", err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading envelope was failed: %w", err)
+	}
+	return req, body, nil
+}
+
+// responseHead encodes the head of a response. The Content-Length is left
+// out if length is negative, so that the body lasts until the end of the
+// message.
+func responseHead(status int, header http.Header, length int) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "HTTP/1.1 %03d %s\r\n", status, http.StatusText(status))
+	header.WriteSubset(out, map[string]bool{"Content-Length": true})
+	if length >= 0 {
+		fmt.Fprintf(out, "Content-Length: %d\r\n", length)
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// openResponse splits a message into its response envelope and the body.
+func openResponse(message []byte) (*http.Response, []byte, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(message)), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading envelope was failed: %w", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading envelope was failed: %w", err)
+	}
+	return resp, body, nil
+}
+
+// decodeEnvelope decodes the responses in a response envelope. A body
+// which isn't JSON-RPC is turned into a response holding a StatusError
+// unless the status is 2xx.
+func decodeEnvelope(message []byte) ([]*JsonRpcResponse, error) {
+	envelope, body, err := openResponse(message)
+	if err != nil {
+		return nil, err
+	}
+
+	resps, err := decodeMessage(body)
+	if err != nil && envelope.StatusCode/100 == 2 {
+		return nil, err
+	}
+	if err != nil {
+		resp := &JsonRpcResponse{
+			Version: "2.0",
+			statusErr: &StatusError{
+				StatusCode: envelope.StatusCode,
+				Status:     envelope.Status,
+				Header:     envelope.Header,
+				Body:       body,
+			},
+		}
+		if id := envelope.Header.Get(idHeader); id != "" {
+			dec := json.NewDecoder(bytes.NewReader([]byte(id)))
+			dec.UseNumber()
+			dec.Decode(&resp.Id)
+		}
+		resps = []*JsonRpcResponse{resp}
+	}
+
+	for _, resp := range resps {
+		resp.Status = envelope.StatusCode
+		resp.Header = envelope.Header
+	}
+	return resps, nil
+}
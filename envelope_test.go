@@ -0,0 +1,112 @@
+package kuda
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClient_Path(t *testing.T) {
+	echo := echoHandler(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Method is not match\nwant: %v\ngot:  %v", http.MethodPost, r.Method)
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type is not match\nwant: %v\ngot:  %v", "application/json", got)
+		}
+		if got := r.Header.Get("X-Token"); got != "secret" {
+			t.Errorf("Header is not match\nwant: %v\ngot:  %v", "secret", got)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Served-By", "mux")
+		w.WriteHeader(http.StatusAccepted)
+		echo.ServeHTTP(w, r)
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, mux)
+	defer serverPort.Close()
+
+	client := &Client{
+		Dialer: clientPort.Dialer,
+		Path:   "/rpc",
+		Header: http.Header{"X-Token": {"secret"}},
+	}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Call("Echo.Echo", []string{"test"})
+	if err != nil {
+		t.Fatalf("Call was failed: %v", err)
+	}
+	if response.Status != http.StatusAccepted {
+		t.Errorf("Status is not match\nwant: %v\ngot:  %v", http.StatusAccepted, response.Status)
+	}
+	if got := response.Header.Get("X-Served-By"); got != "mux" {
+		t.Errorf("Header is not match\nwant: %v\ngot:  %v", "mux", got)
+	}
+	var result []string
+	if err := response.GetObject(&result); err != nil {
+		t.Errorf("GetObject was failed: %v", err)
+	} else if len(result) != 1 || result[0] != "test" {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{"test"}, result)
+	}
+
+	// a batch is routed as a whole
+	calls := []*BatchCall{
+		{Method: "Echo.Echo", Params: []string{"first"}},
+		{Method: "Echo.Echo", Params: []string{"second"}},
+	}
+	if err := client.Batch(calls); err != nil {
+		t.Fatalf("Batch was failed: %v", err)
+	}
+	for _, call := range calls {
+		if call.Err != nil {
+			t.Errorf("Batch call was failed: %v", call.Err)
+		}
+	}
+
+	// the 404 of the mux has no JSON-RPC id
+	client.Path = "/missing"
+	_, err = client.Call("Echo.Echo", []string{"test"})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("Error is not StatusError: %v", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound || statusErr.Status != "404 Not Found" {
+		t.Errorf("Status is not match\nwant: %v\ngot:  %v", "404 Not Found", statusErr.Status)
+	}
+	if !bytes.Contains(statusErr.Body, []byte("404 page not found")) {
+		t.Errorf("Body is not match\nwant: %v\ngot:  %s", "404 page not found", statusErr.Body)
+	}
+	// an application error with a server-defined code is not a status
+	if errors.As(err, new(*JsonRpcError)) {
+		t.Errorf("Error is a JsonRpcError: %v", err)
+	}
+}
+
+func TestClient_withoutPath(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "" || len(r.Header) != 0 {
+			t.Errorf("Request has an envelope: %v %v", r.URL, r.Header)
+		}
+		// dropped without an envelope
+		w.WriteHeader(http.StatusTeapot)
+		echoHandler(t).ServeHTTP(w, r)
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	response, err := client.Call("Echo.Echo", []string{"test"})
+	if err != nil {
+		t.Fatalf("Call was failed: %v", err)
+	}
+	if response.Status != 0 || response.Header != nil {
+		t.Errorf("Response has an envelope: %v %v", response.Status, response.Header)
+	}
+}
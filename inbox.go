@@ -0,0 +1,63 @@
+package kuda
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// message is a received message or the reason why it was lost.
+type message struct {
+	data *bytes.Buffer
+	err  error
+}
+
+func (msg message) unpack() (*bytes.Buffer, error) {
+	if msg.err != nil {
+		return nil, fmt.Errorf("[kuda.ReadPacket] read error: %w", msg.err)
+	}
+	return msg.data, nil
+}
+
+// inbox queues received messages until ReadPacket takes them. It never
+// blocks the receive goroutine, which has to keep handling ACKs. Instead the
+// receive goroutine stops accepting data frames while it is full.
+type inbox struct {
+	mutex    sync.Mutex
+	messages []message
+	limit    int
+	// arrived is closed and replaced whenever a message is pushed.
+	arrived chan struct{}
+}
+
+func newInbox(limit int) *inbox {
+	return &inbox{limit: limit, arrived: make(chan struct{})}
+}
+
+// full reports whether the queue holds limit messages or more.
+func (q *inbox) full() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages) >= q.limit
+}
+
+func (q *inbox) push(msg message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.messages = append(q.messages, msg)
+	close(q.arrived)
+	q.arrived = make(chan struct{})
+}
+
+// pop takes the oldest message. If there is none, it returns a channel
+// which is closed when one arrives.
+func (q *inbox) pop() (message, bool, <-chan struct{}) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) == 0 {
+		return message{}, false, q.arrived
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return msg, true, nil
+}
@@ -6,6 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.bug.st/serial"
@@ -14,34 +19,202 @@ import (
 type Packet struct {
 	Data []byte
 	Next byte
+	Seq  uint32
+
+	flags byte
 }
 
-func sendPacket(buf io.Writer, next byte, body []byte) (int, error) {
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(body))); err != nil {
-		return 0, err
+const (
+	flagNext byte = 1 << iota
+	flagACK
+	flagNAK
+	flagCRC16
+	// flagSYN marks the request which starts a session and its ACK. The
+	// body holds the window size as uint16. Together with flagNAK, it asks
+	// the peer to start a new session, since the frame doesn't belong to
+	// the current one.
+	flagSYN
+
+	flagMask = flagNext | flagACK | flagNAK | flagCRC16 | flagSYN
+)
+
+// frameMagic marks the start of every frame so that the receiver can find
+// the next frame again after line noise.
+var frameMagic = []byte{0x4B, 0x44}
+
+// frame header: magic(2) + length(4) + flags(1) + sequence number(4)
+const headerSize = 11
+
+var (
+	// ErrFrameTooLarge is passed to OnError when a received frame header
+	// announces a body larger than MaxFrameSize. As noise may look like
+	// such a header, it isn't returned by ReadPacket, and the frame is
+	// counted in Stats.OversizedFrames.
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrMessageTooLarge is returned when a received message is larger
+	// than MaxMessageSize.
+	ErrMessageTooLarge = errors.New("message is too large")
+	// ErrTimeout is returned when nothing arrived in time, e.g. by
+	// ReadPacket after its read timeout.
+	ErrTimeout = errors.New("timeout error was happened")
+	// ErrNoResponse is matched by a RetryError, which Write returns when
+	// the peer didn't answer a frame however often it was sent.
+	ErrNoResponse = errors.New("peer is not responding")
+	// ErrPortClosed is matched by errors of a port which has been closed,
+	// either by Close or because the transport has gone.
+	ErrPortClosed = errors.New("port was closed")
+	// ErrFraming is matched by errors caused by frames corrupted on the
+	// line, which were reported by the peer with NAK.
+	ErrFraming = errors.New("framing error")
+)
+
+var (
+	errChecksum = fmt.Errorf("checksum mismatch: %w", ErrFraming)
+	errNAK      = fmt.Errorf("NAK has been received: %w", ErrFraming)
+	// errClosedByClose tells a port closed on purpose from a failed one.
+	errClosedByClose = fmt.Errorf("%w by Close", ErrPortClosed)
+	errReadCancelled = errors.New("reading was cancelled")
+	// errResync is received when the peer has no session the frames in
+	// flight belong to, e.g. because it has been reopened.
+	errResync = errors.New("peer has asked for a new session")
+	// errSessionLost is returned for the rest of a message whose session
+	// has ended in the middle of it.
+	errSessionLost = errors.New("session was lost in the middle of a message")
+)
+
+// portError is an error reported by the transport itself, e.g. because the
+// device has been unplugged.
+type portError struct {
+	err error
+}
+
+func (e *portError) Error() string {
+	return e.err.Error()
+}
+
+func (e *portError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the port has been closed, by Close or by the other
+// side of the transport.
+func (e *portError) Is(target error) bool {
+	if target != ErrPortClosed {
+		return false
 	}
 
-	// next
-	if err := binary.Write(buf, binary.BigEndian, next); err != nil {
-		return 0, err
+	var serialErr *serial.PortError
+	if errors.As(e.err, &serialErr) {
+		return serialErr.Code() == serial.PortClosed
 	}
+	return errors.Is(e.err, io.EOF) || errors.Is(e.err, io.ErrClosedPipe) ||
+		errors.Is(e.err, net.ErrClosed) || errors.Is(e.err, os.ErrClosed)
+}
+
+func isPortError(err error) bool {
+	var e *portError
+	return errors.As(err, &e)
+}
 
-	// body
-	if err := binary.Write(buf, binary.BigEndian, []byte(body)); err != nil {
+func sendPacket(buf io.Writer, checksum Checksum, flags byte, seq uint32, body []byte) (int, error) {
+	frame := make([]byte, headerSize, headerSize+len(body)+checksum.size())
+	copy(frame, frameMagic)
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(body)))
+	frame[6] = flags | checksum.flag()
+	binary.BigEndian.PutUint32(frame[7:], seq)
+	frame = append(frame, body...)
+	frame = checksum.append(frame, frame)
+
+	if _, err := buf.Write(frame); err != nil {
 		return 0, err
 	}
 
 	return len(body), nil
 }
 
+// Stats holds counters of a link.
+type Stats struct {
+	// DiscardedBytes is the number of received bytes which didn't belong
+	// to any valid frame.
+	DiscardedBytes uint64
+	// OversizedFrames is the number of received frame headers which
+	// announced a body larger than MaxFrameSize.
+	OversizedFrames uint64
+}
+
+// Kuda is a link over a serial port. Once opened, a goroutine receives
+// frames in the background, so Write and ReadPacket may be used at the
+// same time from different goroutines.
 type Kuda struct {
 	PortName  string
 	Mode      *serial.Mode
 	WriteSize int
 
-	rxBuffer  *bytes.Buffer
-	port      serial.Port
-	rxTimeout time.Duration
+	// Checksum is the integrity check appended to frames sent by this side.
+	Checksum Checksum
+	// Retry controls timeouts and retransmissions.
+	Retry RetryPolicy
+	// Dialer opens the transport of the link. If nil, the serial port
+	// PortName is opened with Mode.
+	Dialer func() (Transport, error)
+	// MaxFrameSize is the largest frame body accepted from the peer.
+	// Zero means 1 MiB.
+	MaxFrameSize int
+	// MaxMessageSize is the largest message ReadPacket assembles from
+	// frames. Zero means 64 MiB.
+	MaxMessageSize int
+	// Window is the number of frames Write keeps in flight before it waits
+	// for an ACK. The size is negotiated with the peer, which has to allow
+	// a window as well, and the smaller one is used in each direction. It
+	// is negotiated again whenever the peer has lost the session or a
+	// message couldn't be delivered. Zero or one means stop-and-wait.
+	Window int
+	// ReadTimeout is how long ReadPacket waits for a message. Zero waits
+	// forever.
+	ReadTimeout time.Duration
+	// QueueSize is the number of received messages kept until ReadPacket
+	// takes them. While the queue is full, data frames aren't acknowledged,
+	// so the peer waits and sends them again. Zero means 16.
+	QueueSize int
+	// OnError is called by the receive goroutine with errors of received
+	// frames which are dropped without failing ReadPacket, such as
+	// ErrFrameTooLarge. It must not block. If nil, they are only counted
+	// in Stats.
+	OnError func(err error)
+
+	port Transport
+
+	// sendMutex serializes messages and writeMutex serializes frames.
+	sendMutex  sync.Mutex
+	writeMutex sync.Mutex
+	// txSeq is the sequence number of the next data frame to send.
+	txSeq      uint32
+	txWindow   int
+	negotiated bool
+	// partial is set while a message has been begun but not ended.
+	partial bool
+	// acks passes ACK and NAK frames from the receiver to Write.
+	acks chan *Packet
+
+	// The receiver state below is owned by the receive goroutine.
+	rxBuffer *bytes.Buffer
+	// rxSeq is the sequence number of the last accepted data frame.
+	rxSeq      uint32
+	rxSeqValid bool
+	rxWindow   int
+	// message is the message being assembled from data frames.
+	message  *bytes.Buffer
+	tooLarge bool
+
+	inbox     *inbox
+	closing   chan struct{}
+	closeOnce *sync.Once
+	// done is closed with rxErr set when the receive goroutine ends.
+	done  chan struct{}
+	rxErr error
+
+	discarded atomic.Uint64
+	oversized atomic.Uint64
 }
 
 var openSerial = func(portname string, mode *serial.Mode) (serial.Port, error) {
@@ -49,29 +222,99 @@ var openSerial = func(portname string, mode *serial.Mode) (serial.Port, error) {
 }
 
 func (kuda *Kuda) Open() (err error) {
-	kuda.port, err = openSerial(kuda.PortName, kuda.Mode)
-	if err != nil {
-		return fmt.Errorf("opening serial port was failed: %w", err)
+	if kuda.Dialer != nil {
+		if kuda.port, err = kuda.Dialer(); err != nil {
+			// the state of the previous session must not be used
+			kuda.port, kuda.done = nil, nil
+			return fmt.Errorf("opening transport was failed: %w", err)
+		}
+	} else {
+		if kuda.port, err = openSerial(kuda.PortName, kuda.Mode); err != nil {
+			kuda.port, kuda.done = nil, nil
+			return fmt.Errorf("opening serial port was failed: %w", err)
+		}
 	}
 	kuda.rxBuffer = &bytes.Buffer{}
-	kuda.rxTimeout = serial.NoTimeout
 	if kuda.WriteSize == 0 {
 		kuda.WriteSize = 1024
 	}
-
-	if err = kuda.port.ResetOutputBuffer(); err != nil {
-		return fmt.Errorf("reset output buffer was failed: %w", err)
+	if kuda.MaxFrameSize == 0 {
+		kuda.MaxFrameSize = 1 << 20
+	}
+	if kuda.MaxMessageSize == 0 {
+		kuda.MaxMessageSize = 64 << 20
 	}
+	if kuda.QueueSize == 0 {
+		kuda.QueueSize = 16
+	}
+
+	// A random initial sequence number keeps the peer from taking the first
+	// frame after reopening for a retransmission of the previous session.
+	kuda.txSeq = rand.Uint32()
+	kuda.txWindow = 1
+	kuda.negotiated = false
+	kuda.partial = false
+	kuda.acks = make(chan *Packet, 64)
+	kuda.rxSeqValid = false
+	kuda.rxWindow = 1
+	kuda.message = nil
+	kuda.tooLarge = false
+	kuda.inbox = newInbox(kuda.QueueSize)
+	kuda.closing = make(chan struct{})
+	kuda.closeOnce = &sync.Once{}
+	kuda.done = make(chan struct{})
+	kuda.rxErr = nil
+
+	if port, ok := kuda.port.(bufferResetter); ok {
+		if err = port.ResetOutputBuffer(); err != nil {
+			kuda.port.Close()
+			kuda.port, kuda.done = nil, nil
+			return fmt.Errorf("reset output buffer was failed: %w", err)
+		}
 
-	if err = kuda.port.ResetInputBuffer(); err != nil {
-		return fmt.Errorf("reset input buffer was failed: %w", err)
+		if err = port.ResetInputBuffer(); err != nil {
+			kuda.port.Close()
+			kuda.port, kuda.done = nil, nil
+			return fmt.Errorf("reset input buffer was failed: %w", err)
+		}
 	}
 
+	go kuda.receive()
+
 	return nil
 }
 
+// Close closes the port and waits for the receive goroutine to end.
+// Pending ReadPacket and Write calls fail.
 func (kuda *Kuda) Close() error {
-	return kuda.port.Close()
+	if kuda.port == nil {
+		return nil
+	}
+
+	kuda.closeOnce.Do(func() {
+		close(kuda.closing)
+	})
+	err := kuda.port.Close()
+	<-kuda.done
+	return err
+}
+
+// clone returns an unopened link with the same settings.
+func (kuda *Kuda) clone() *Kuda {
+	return &Kuda{
+		PortName:       kuda.PortName,
+		Mode:           kuda.Mode,
+		WriteSize:      kuda.WriteSize,
+		Checksum:       kuda.Checksum,
+		Retry:          kuda.Retry,
+		Dialer:         kuda.Dialer,
+		MaxFrameSize:   kuda.MaxFrameSize,
+		MaxMessageSize: kuda.MaxMessageSize,
+		Window:         kuda.Window,
+		ReadTimeout:    kuda.ReadTimeout,
+		QueueSize:      kuda.QueueSize,
+		OnError:        kuda.OnError,
+	}
 }
 
 func (kuda *Kuda) Reopen() error {
@@ -86,122 +329,577 @@ func (kuda *Kuda) Reopen() error {
 	return nil
 }
 
-func (kuda *Kuda) waitACK() error {
-	origTimeout := kuda.rxTimeout
-	kuda.rxTimeout = 1 * time.Second
-	defer func() {
-		kuda.rxTimeout = origTimeout
-	}()
+// Stats returns the counters of the link.
+func (kuda *Kuda) Stats() Stats {
+	return Stats{
+		DiscardedBytes:  kuda.discarded.Load(),
+		OversizedFrames: kuda.oversized.Load(),
+	}
+}
 
-	_, err := kuda.read()
+// waitACK waits for an ACK of any frame from first to last and returns it.
+// If syn is set, it waits for the ACK of a SYN instead of a data frame. A
+// SYN and the first data frame of a session have the same sequence number,
+// so a late ACK of the one must not be taken for the other.
+func (kuda *Kuda) waitACK(first, last uint32, syn bool) (*Packet, error) {
+	timer := time.NewTimer(kuda.ackTimeout())
+	defer timer.Stop()
 
-	return err
+	for {
+		select {
+		case packet := <-kuda.acks:
+			if packet.flags&(flagNAK|flagSYN) == flagNAK|flagSYN {
+				return nil, errResync
+			}
+			if packet.flags&flagNAK != 0 {
+				// A NAK carries the last frame the peer has accepted, so
+				// it rejects the frame after it. NAKs of other frames,
+				// e.g. sent for a corrupted ACK or for noise, are ignored.
+				if packet.Seq+1-first <= last-first {
+					return nil, errNAK
+				}
+				continue
+			}
+			if (packet.flags&flagSYN != 0) == syn && packet.Seq-first <= last-first {
+				return packet, nil
+			}
+			// a late ACK for a retransmitted frame or SYN
+		case <-timer.C:
+			return nil, ErrTimeout
+		case <-kuda.done:
+			return nil, kuda.rxErr
+		}
+	}
 }
 
-func (kuda *Kuda) sendACK() error {
-	if _, err := sendPacket(kuda.port, 0, []byte{0}); err != nil {
-		return err
+// send writes a frame to the port.
+func (kuda *Kuda) send(flags byte, seq uint32, body []byte) error {
+	kuda.writeMutex.Lock()
+	defer kuda.writeMutex.Unlock()
+
+	// A closed serial port may fail with a plain EBADF, or write to a file
+	// descriptor which has been reused.
+	if isClosed(kuda.closing) {
+		return &portError{errClosedByClose}
+	}
+	if _, err := sendPacket(kuda.port, kuda.Checksum, flags, seq, body); err != nil {
+		return &portError{err}
 	}
 
 	return nil
 }
 
+func (kuda *Kuda) sendACK(seq uint32) error {
+	return kuda.send(flagACK, seq, nil)
+}
+
+// sendNAK rejects the frame after the last accepted one.
+func (kuda *Kuda) sendNAK() error {
+	return kuda.send(flagNAK, kuda.rxSeq, nil)
+}
+
+// sendResync asks the peer to start a new session.
+func (kuda *Kuda) sendResync() error {
+	return kuda.send(flagNAK|flagSYN, kuda.rxSeq, nil)
+}
+
+// accept acknowledges a received data frame and reports whether it is the
+// next one in order. Retransmissions of accepted frames and frames beyond
+// a lost one are acknowledged with the last accepted sequence number but
+// must not be delivered. Frames which don't belong to the session, e.g.
+// because this side has been reopened, make the peer start a new one.
+func (kuda *Kuda) accept(packet *Packet) (bool, error) {
+	if !kuda.rxSeqValid {
+		return false, kuda.sendResync()
+	}
+
+	d := packet.Seq - kuda.rxSeq
+	duplicate := int32(d) <= 0 && int32(d) > -int32(kuda.rxWindow)
+	outOfOrder := d > 1 && d <= uint32(kuda.rxWindow)
+	switch {
+	case d == 1:
+		kuda.rxSeq = packet.Seq
+		return true, kuda.sendACK(packet.Seq)
+	case duplicate || outOfOrder:
+		return false, kuda.sendACK(kuda.rxSeq)
+	default:
+		return false, kuda.sendResync()
+	}
+}
+
+// acceptSYN starts a session requested by the peer and answers it with the
+// window. The sender's sequence number in the request becomes the base of
+// the following data frames, and a message the previous session has left
+// incomplete is dropped.
+func (kuda *Kuda) acceptSYN(packet *Packet) error {
+	window := 1
+	if len(packet.Data) == 2 {
+		window = min(int(binary.BigEndian.Uint16(packet.Data)), max(kuda.Window, 1))
+	}
+	kuda.rxWindow = window
+	kuda.rxSeq = packet.Seq - 1
+	kuda.rxSeqValid = true
+	kuda.message = nil
+	kuda.tooLarge = false
+
+	body := binary.BigEndian.AppendUint16(nil, uint16(window))
+	return kuda.send(flagACK|flagSYN, packet.Seq, body)
+}
+
+// negotiate starts a session with the peer before the first message after
+// opening, and whenever the peer has lost the session. The peer drops what
+// it has received of an incomplete message and agrees on the window.
+func (kuda *Kuda) negotiate() error {
+	if kuda.negotiated {
+		return nil
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, uint16(min(max(kuda.Window, 1), 0xFFFF)))
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		if err := kuda.send(flagSYN, kuda.txSeq, body); err != nil {
+			return err
+		}
+
+		packet, err := kuda.waitACK(kuda.txSeq, kuda.txSeq, true)
+		if err == nil {
+			kuda.txWindow = 1
+			if len(packet.Data) == 2 {
+				kuda.txWindow = max(int(binary.BigEndian.Uint16(packet.Data)), 1)
+			}
+			kuda.negotiated = true
+			return nil
+		}
+
+		if !isRetryable(err) {
+			return err
+		}
+		if attempt >= kuda.maxAttempts() {
+			return &RetryError{
+				Seq:        kuda.txSeq,
+				Attempts:   attempt,
+				ACKTimeout: kuda.ackTimeout(),
+				Elapsed:    time.Since(started),
+				Err:        err,
+			}
+		}
+		time.Sleep(kuda.backoff(attempt))
+	}
+}
+
+// Write sends data as one message. Concurrent calls are sent one after
+// another.
 func (kuda *Kuda) Write(data []byte) (n int, err error) {
+	if err := kuda.beginMessage(); err != nil {
+		return 0, err
+	}
+	defer kuda.endMessage()
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return kuda.writePart(data, true)
+}
+
+// beginMessage holds the link for a message which is sent in parts with
+// writePart, until endMessage is called.
+func (kuda *Kuda) beginMessage() error {
+	if kuda.done == nil {
+		return &portError{ErrPortClosed}
+	}
+	if isClosed(kuda.closing) {
+		return &portError{errClosedByClose}
+	}
+
+	kuda.sendMutex.Lock()
+	if kuda.partial {
+		// The previous message was broken off. A new session makes the
+		// peer drop what it has received of it.
+		kuda.partial = false
+		kuda.negotiated = false
+	}
+	return nil
+}
+
+func (kuda *Kuda) endMessage() {
+	kuda.sendMutex.Unlock()
+}
+
+// abortMessage releases the link in the middle of a message. The next
+// message starts a new session, which makes the peer drop what it has
+// received of this one.
+func (kuda *Kuda) abortMessage() {
+	kuda.partial = true
+	kuda.sendMutex.Unlock()
+}
+
+// writePart sends data as frames of the current message. Unless last is
+// set, the message goes on with the next part. The last part may be empty.
+func (kuda *Kuda) writePart(data []byte, last bool) (n int, err error) {
+	kuda.dropACKs()
+	if kuda.partial && !kuda.negotiated {
+		return 0, fmt.Errorf("sending chunk was failed: %w", errSessionLost)
+	}
+	if err := kuda.negotiate(); err != nil {
+		return 0, fmt.Errorf("negotiating session was failed: %w", err)
+	}
+
+	type chunk struct {
+		flags byte
+		data  []byte
+	}
+	var chunks []chunk
 	j := 0
 	for i := 0; i < len(data); i = j {
-		var next byte
+		next := flagNext
 		if i+kuda.WriteSize >= len(data) {
 			j = len(data)
+			if last {
+				next = 0
+			}
 		} else {
 			j = i + kuda.WriteSize
-			next = 1
+		}
+		chunks = append(chunks, chunk{next, data[i:j]})
+	}
+	if len(chunks) == 0 && last {
+		chunks = append(chunks, chunk{0, nil})
+	}
+
+	// Go-Back-N: up to txWindow chunks are in flight. An ACK acknowledges
+	// every chunk up to its sequence number, and on NAK or timeout all
+	// chunks from the oldest unacknowledged one are sent again.
+	begun := kuda.partial
+	kuda.partial = true
+	seq := kuda.txSeq
+	base, next, attempt := 0, 0, 1
+	started := time.Now()
+	for base < len(chunks) {
+		for ; next < len(chunks) && next < base+kuda.txWindow; next++ {
+			c := chunks[next]
+			if err := kuda.send(c.flags, seq+uint32(next), c.data); err != nil {
+				return 0, err
+			}
 		}
 
-		if _, err := sendPacket(kuda.port, next, data[i:j]); err != nil {
-			return 0, err
+		packet, err := kuda.waitACK(seq+uint32(base), seq+uint32(next-1), false)
+		if err == nil {
+			base = int(packet.Seq-seq) + 1
+			attempt = 1
+			started = time.Now()
+			continue
 		}
 
-		if err := kuda.waitACK(); err != nil {
-			return 0, err
+		if errors.Is(err, errResync) {
+			kuda.negotiated = false
+			if begun || base > 0 {
+				// the peer has lost the beginning of the message
+				return 0, fmt.Errorf("sending chunk was failed: %w", errSessionLost)
+			}
+		}
+		if !isRetryable(err) {
+			return 0, fmt.Errorf("sending chunk was failed: %w", err)
+		}
+		if attempt >= kuda.maxAttempts() {
+			// The peer may have been opened again and forgotten the
+			// window, so the next message starts a new session.
+			kuda.negotiated = false
+			return 0, &RetryError{
+				Seq:        seq + uint32(base),
+				Attempts:   attempt,
+				ACKTimeout: kuda.ackTimeout(),
+				Elapsed:    time.Since(started),
+				Err:        err,
+			}
+		}
+		time.Sleep(kuda.backoff(attempt))
+		attempt++
+		next = base
+
+		if !kuda.negotiated {
+			// Nothing has been accepted yet, so the message is sent
+			// again from the beginning in a new session.
+			if err := kuda.negotiate(); err != nil {
+				return 0, fmt.Errorf("negotiating session was failed: %w", err)
+			}
+			seq = kuda.txSeq
 		}
 	}
+	kuda.txSeq = seq + uint32(len(chunks))
+	kuda.partial = !last
 
 	return len(data), nil
 }
 
-func (kuda *Kuda) internalRead(tmpRxBufLen int, readBytes []byte) (int, error) {
-	if tmpRxBufLen > 0 {
-		kuda.port.SetReadTimeout(1 * time.Second)
-	} else {
-		kuda.port.SetReadTimeout(kuda.rxTimeout)
+// dropACKs drops the ACKs and NAKs which arrived while no frame was in
+// flight, so that they aren't taken for answers to the next frames.
+func (kuda *Kuda) dropACKs() {
+	for {
+		select {
+		case <-kuda.acks:
+		default:
+			return
+		}
 	}
+}
+
+func isRetryable(err error) bool {
+	return errors.Is(err, errNAK) || errors.Is(err, ErrTimeout) || errors.Is(err, errResync)
+}
+
+func (kuda *Kuda) internalRead(readBytes []byte) (int, error) {
+	kuda.port.SetReadTimeout(kuda.interByteTimeout())
 	n, err := kuda.port.Read(readBytes)
 	if err != nil {
-		return n, err
+		return n, &portError{err}
 	}
 
 	if n == 0 {
-		return n, errors.New("timeout error was happened")
+		return n, ErrTimeout
 	}
 	return n, nil
 }
 
+// ReadPacket returns the next message received from the peer.
 func (kuda *Kuda) ReadPacket() (*bytes.Buffer, error) {
-	entirePacket := &bytes.Buffer{}
+	return kuda.readPacket(nil)
+}
+
+// readPacket is ReadPacket which gives up with errReadCancelled when cancel
+// is closed.
+func (kuda *Kuda) readPacket(cancel <-chan struct{}) (*bytes.Buffer, error) {
+	if kuda.done == nil {
+		return nil, fmt.Errorf("[kuda.ReadPacket] read error: %w", &portError{ErrPortClosed})
+	}
+
+	var timer <-chan time.Time
+	if kuda.ReadTimeout > 0 {
+		timer = time.After(kuda.ReadTimeout)
+	}
+
 	for {
-		packet, err := kuda.read()
+		msg, ok, arrived := kuda.inbox.pop()
+		if ok {
+			return msg.unpack()
+		}
+
+		select {
+		case <-arrived:
+		case <-timer:
+			return nil, fmt.Errorf("[kuda.ReadPacket] read error: %w", ErrTimeout)
+		case <-cancel:
+			return nil, errReadCancelled
+		case <-kuda.done:
+			// messages queued right before the port failed
+			if msg, ok, _ := kuda.inbox.pop(); ok {
+				return msg.unpack()
+			}
+			return nil, fmt.Errorf("[kuda.ReadPacket] read error: %w", kuda.rxErr)
+		}
+	}
+}
+
+// receive runs until the port is closed. It answers data frames, passes
+// ACK and NAK frames to Write and queues complete messages for ReadPacket.
+func (kuda *Kuda) receive() {
+	defer close(kuda.done)
+
+	readBytes := make([]byte, 2048)
+	for {
+		n, err := kuda.internalRead(readBytes)
+		select {
+		case <-kuda.closing:
+			kuda.rxErr = &portError{errClosedByClose}
+			return
+		default:
+		}
+		if errors.Is(err, ErrTimeout) {
+			// the rest of a partial frame is never going to arrive
+			kuda.discard(kuda.rxBuffer.Len())
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("[kuda.ReadPacket] read error: %w", err)
+			kuda.rxErr = fmt.Errorf("reading buffer was failed:%w", err)
+			return
 		}
-		if _, err := entirePacket.Write(packet.Data); err != nil {
-			return nil, fmt.Errorf("[kuda.ReadPacket] writing packet error: %w", err)
+
+		kuda.rxBuffer.Write(readBytes[:n])
+
+		for {
+			packet, err := kuda.parse()
+			if err == nil && packet == nil {
+				break
+			}
+			if err == nil {
+				err = kuda.handle(packet)
+			} else {
+				err = kuda.reject(err)
+			}
+			if err != nil {
+				kuda.rxErr = err
+				return
+			}
 		}
+	}
+}
 
-		if err := kuda.sendACK(); err != nil {
-			return nil, fmt.Errorf("[kuda.ReadPacket] sendACK error: %w", err)
+// handle processes a received frame.
+func (kuda *Kuda) handle(packet *Packet) error {
+	switch {
+	case packet.flags&(flagACK|flagNAK) != 0:
+		kuda.deliverACK(packet)
+	case packet.flags&flagSYN != 0:
+		if err := kuda.acceptSYN(packet); err != nil {
+			return fmt.Errorf("sendACK error: %w", err)
+		}
+	case kuda.inbox.full():
+		// The frame is neither accepted nor acknowledged, so that the
+		// peer sends it again once ReadPacket has made room.
+	default:
+		accepted, err := kuda.accept(packet)
+		if err != nil {
+			return fmt.Errorf("sendACK error: %w", err)
+		}
+		if accepted {
+			kuda.assemble(packet)
 		}
+	}
+	return nil
+}
 
-		if packet.Next == 0 {
-			return entirePacket, nil
+// reject answers a frame which couldn't be parsed with NAK. An oversized
+// frame is counted and passed to OnError, but not to ReadPacket, because
+// its header may be noise.
+func (kuda *Kuda) reject(err error) error {
+	if errors.Is(err, ErrFrameTooLarge) {
+		kuda.oversized.Add(1)
+		if kuda.OnError != nil {
+			kuda.OnError(err)
 		}
 	}
+
+	if err := kuda.sendNAK(); err != nil {
+		return fmt.Errorf("sendNAK error: %w", err)
+	}
+	return nil
 }
 
-func (kuda *Kuda) read() (packet *Packet, err error) {
-	readBytes := make([]byte, 2048)
-	var size int32
-	var next byte
-	first := true
+// deliverACK passes an ACK or NAK to Write. If nobody has taken the
+// previous ones, the oldest is dropped.
+func (kuda *Kuda) deliverACK(packet *Packet) {
 	for {
-		var n int
+		select {
+		case kuda.acks <- packet:
+			return
+		default:
+		}
 
-		if !(first && kuda.rxBuffer.Len() > 0) {
-			n, err = kuda.internalRead(kuda.rxBuffer.Len(), readBytes)
-			if err != nil {
-				return nil, fmt.Errorf("reading buffer was failed:%w", err)
-			}
+		select {
+		case <-kuda.acks:
+		default:
 		}
-		first = false
+	}
+}
 
-		kuda.rxBuffer.Write(readBytes[:n])
+// assemble appends an accepted data frame to the current message.
+func (kuda *Kuda) assemble(packet *Packet) {
+	if kuda.message == nil {
+		kuda.message = &bytes.Buffer{}
+	}
 
-		if size == 0 {
-			if kuda.rxBuffer.Len() < 5 {
-				continue
-			}
+	// The rest of an oversized message is still received and thrown
+	// away, so that it isn't taken for the beginning of the next one.
+	if kuda.message.Len()+len(packet.Data) > kuda.MaxMessageSize {
+		kuda.tooLarge = true
+		kuda.message.Reset()
+	}
+	if !kuda.tooLarge {
+		kuda.message.Write(packet.Data)
+	}
+
+	if packet.Next != 0 {
+		return
+	}
+
+	if kuda.tooLarge {
+		kuda.inbox.push(message{err: fmt.Errorf("%w (limit: %d bytes)", ErrMessageTooLarge, kuda.MaxMessageSize)})
+	} else {
+		kuda.inbox.push(message{data: kuda.message})
+	}
+	kuda.message = nil
+	kuda.tooLarge = false
+}
 
-			size = int32(binary.BigEndian.Uint32(kuda.rxBuffer.Next(4)))
-			if next, err = kuda.rxBuffer.ReadByte(); err != nil {
-				return nil, fmt.Errorf("parsing received data was failed: %w", err)
+// parse extracts a frame from the head of rxBuffer. It skips bytes until
+// the next frame marker and returns nil without error if the frame isn't
+// complete yet.
+func (kuda *Kuda) parse() (*Packet, error) {
+	for {
+		buf := kuda.rxBuffer.Bytes()
+		i := bytes.Index(buf, frameMagic)
+		if i < 0 {
+			// keep the last byte which may be the first half of the marker
+			i = len(buf)
+			if i > 0 && buf[i-1] == frameMagic[0] {
+				i--
 			}
 		}
+		kuda.discard(i)
+
+		if kuda.rxBuffer.Len() < headerSize {
+			return nil, nil
+		}
+
+		header := kuda.rxBuffer.Bytes()[:headerSize]
+		length := binary.BigEndian.Uint32(header[2:])
+		flags := header[6]
+		seq := binary.BigEndian.Uint32(header[7:])
+		checksum := checksumOf(flags)
 
-		if kuda.rxBuffer.Len() < int(size) {
+		if flags&^flagMask != 0 {
+			// the marker was a part of garbage
+			kuda.discard(1)
 			continue
 		}
 
-		packet = &Packet{Data: kuda.rxBuffer.Next(int(size)), Next: next}
+		if uint64(length) > uint64(kuda.MaxFrameSize) {
+			// Never wait for such a body. Whether the header is broken or
+			// the peer is misbehaving, the next frame is searched for.
+			kuda.discard(1)
+			return nil, fmt.Errorf("%w (%d bytes, limit: %d bytes)", ErrFrameTooLarge, length, kuda.MaxFrameSize)
+		}
+		size := int(length)
+
+		frameSize := headerSize + size + checksum.size()
+		if kuda.rxBuffer.Len() < frameSize {
+			return nil, nil
+		}
+
+		frame := kuda.rxBuffer.Bytes()[:frameSize]
+		body := frame[:headerSize+size]
+		if !checksum.verify(body, frame[len(body):]) {
+			// Drop only the marker. The length may be broken as well, so
+			// the next frame is searched from right after it.
+			kuda.discard(1)
+			return nil, errChecksum
+		}
+
+		packet := &Packet{
+			Data:  bytes.Clone(body[headerSize:]),
+			Next:  flags & flagNext,
+			Seq:   seq,
+			flags: flags,
+		}
+		kuda.rxBuffer.Next(frameSize)
 
 		return packet, nil
 	}
 }
+
+func (kuda *Kuda) discard(n int) {
+	if n == 0 {
+		return
+	}
+	kuda.rxBuffer.Next(n)
+	kuda.discarded.Add(uint64(n))
+}
@@ -2,8 +2,11 @@ package kuda
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,7 +18,7 @@ type DummyPort struct {
 	InnerRxBuffer io.ReadWriter
 	InnerTxBuffer io.ReadWriter
 	rxTimeout     time.Duration
-	closed        bool
+	closed        atomic.Bool
 }
 
 func (dp *DummyPort) SetMode(mode *serial.Mode) error { return nil }
@@ -23,10 +26,11 @@ func (dp *DummyPort) Read(p []byte) (n int, err error) {
 	timeout := time.Now().Add(dp.rxTimeout)
 	for dp.rxTimeout == serial.NoTimeout || time.Now().Before(timeout) {
 		if n, err := dp.InnerRxBuffer.Read(p); err != nil {
-			if dp.closed {
-				return 0, errors.New("port was closed")
+			if dp.closed.Load() {
+				return 0, io.ErrClosedPipe
 			}
 			if err == io.EOF {
+				runtime.Gosched()
 				continue
 			}
 			return n, err
@@ -52,7 +56,7 @@ func (dp *DummyPort) SetReadTimeout(t time.Duration) error {
 	return nil
 }
 func (dp *DummyPort) Close() error {
-	dp.closed = true
+	dp.closed.Store(true)
 	return nil
 }
 func (dp *DummyPort) Break(time.Duration) error { return nil }
@@ -67,8 +71,20 @@ func newOpenSerialFunc(rxbuf io.ReadWriter, txbuf io.ReadWriter) func() {
 	}
 }
 
-func TestOpen(t *testing.T) {
+func ackFrame(checksum Checksum, seq uint32) []byte {
+	buf := &bytes.Buffer{}
+	sendPacket(buf, checksum, flagACK, seq, nil)
+	return buf.Bytes()
+}
+
+func nakFrame(checksum Checksum, seq uint32) []byte {
 	buf := &bytes.Buffer{}
+	sendPacket(buf, checksum, flagNAK, seq, nil)
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	buf := &testutil.SafeBuffer{}
 	defer newOpenSerialFunc(buf, buf)()
 	kuda := &Kuda{
 		PortName: "COM1",
@@ -84,8 +100,8 @@ func TestOpen(t *testing.T) {
 }
 
 func TestRead(t *testing.T) {
-	rxbuf := &bytes.Buffer{}
-	txbuf := &bytes.Buffer{}
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
 	defer newOpenSerialFunc(rxbuf, txbuf)()
 	kuda := &Kuda{
 		PortName: "COM1",
@@ -100,7 +116,8 @@ func TestRead(t *testing.T) {
 	}
 
 	body := "test"
-	if _, err := sendPacket(rxbuf, 0, []byte(body)); err != nil {
+	rxbuf.Write(synFrame(CRC32, 0))
+	if _, err := sendPacket(rxbuf, CRC32, 0, 0, []byte(body)); err != nil {
 		t.Errorf("Making packet was failed: %v", err)
 	}
 
@@ -111,7 +128,7 @@ func TestRead(t *testing.T) {
 			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		expectedAckData := []byte{0, 0, 0, 1, 0, 0}
+		expectedAckData := append(synACKFrame(CRC32, 0), ackFrame(CRC32, 0)...)
 		if !bytes.Equal(txbuf.Bytes(), expectedAckData) {
 			t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedAckData, txbuf.Bytes())
 		}
@@ -140,7 +157,8 @@ func TestRead_1024bytes(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	if _, err := sendPacket(rxbuf, 0, []byte(body)); err != nil {
+	rxbuf.Write(synFrame(CRC32, 0))
+	if _, err := sendPacket(rxbuf, CRC32, 0, 0, []byte(body)); err != nil {
 		t.Errorf("Making packet was failed: %v", err)
 	}
 
@@ -151,7 +169,7 @@ func TestRead_1024bytes(t *testing.T) {
 			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		expectedAckData := []byte{0, 0, 0, 1, 0, 0}
+		expectedAckData := append(synACKFrame(CRC32, 0), ackFrame(CRC32, 0)...)
 		if !bytes.Equal(txbuf.Bytes(), expectedAckData) {
 			t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedAckData, txbuf.Bytes())
 		}
@@ -178,7 +196,8 @@ func TestRead_1025bytes(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	if _, err := sendPacket(rxbuf, 0, []byte(body)); err != nil {
+	rxbuf.Write(synFrame(CRC32, 0))
+	if _, err := sendPacket(rxbuf, CRC32, 0, 0, []byte(body)); err != nil {
 		t.Errorf("Making packet was failed: %v", err)
 	}
 
@@ -189,7 +208,7 @@ func TestRead_1025bytes(t *testing.T) {
 			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		expectedAckData := []byte{0, 0, 0, 1, 0, 0}
+		expectedAckData := append(synACKFrame(CRC32, 0), ackFrame(CRC32, 0)...)
 		if !bytes.Equal(txbuf.Bytes(), expectedAckData) {
 			t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedAckData, txbuf.Bytes())
 		}
@@ -216,7 +235,8 @@ func TestRead_65535bytes(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	if _, err := sendPacket(rxbuf, 0, []byte(body)); err != nil {
+	rxbuf.Write(synFrame(CRC32, 0))
+	if _, err := sendPacket(rxbuf, CRC32, 0, 0, []byte(body)); err != nil {
 		t.Errorf("Making packet was failed: %v", err)
 	}
 
@@ -227,7 +247,7 @@ func TestRead_65535bytes(t *testing.T) {
 			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		expectedAckData := []byte{0, 0, 0, 1, 0, 0}
+		expectedAckData := append(synACKFrame(CRC32, 0), ackFrame(CRC32, 0)...)
 		if !bytes.Equal(txbuf.Bytes(), expectedAckData) {
 			t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedAckData, txbuf.Bytes())
 		}
@@ -255,9 +275,9 @@ func TestRead_slowReceive(t *testing.T) {
 	}
 
 	go func() {
-		tmpBuf := &bytes.Buffer{}
+		tmpBuf := bytes.NewBuffer(synFrame(CRC32, 0))
 		byteBody := []byte(body)
-		if _, err := sendPacket(tmpBuf, 0, byteBody); err != nil {
+		if _, err := sendPacket(tmpBuf, CRC32, 0, 0, byteBody); err != nil {
 			t.Errorf("Making packet was failed: %v", err)
 		}
 
@@ -274,7 +294,7 @@ func TestRead_slowReceive(t *testing.T) {
 			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		expectedAckData := []byte{0, 0, 0, 1, 0, 0}
+		expectedAckData := append(synACKFrame(CRC32, 0), ackFrame(CRC32, 0)...)
 		if !bytes.Equal(txbuf.Bytes(), expectedAckData) {
 			t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedAckData, txbuf.Bytes())
 		}
@@ -302,7 +322,13 @@ func TestWrite(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	rxbuf.Write([]byte{0, 0, 0, 1, 0, 0})
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	if _, err := sendPacket(wantBuffer, CRC32, 0, seq, []byte(body)); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
 
 	if n, err := kuda.Write([]byte(body)); err != nil {
 		t.Errorf("Read was failed: %v", err)
@@ -311,11 +337,6 @@ func TestWrite(t *testing.T) {
 			t.Errorf("Read count is not match (want: %d, got: %d)", len(body), n)
 		}
 
-		wantBuffer := &bytes.Buffer{}
-		if _, err := sendPacket(wantBuffer, 0, []byte(body)); err != nil {
-			t.Errorf("Making packet was failed: %v", err)
-		}
-
 		if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
 			t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
 		}
@@ -343,7 +364,13 @@ func Test_1024Write(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	rxbuf.Write([]byte{0, 0, 0, 1, 0, 0})
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	if _, err := sendPacket(wantBuffer, CRC32, 0, seq, []byte(body)); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
 
 	if n, err := kuda.Write([]byte(body)); err != nil {
 		t.Errorf("Read was failed: %v", err)
@@ -352,11 +379,6 @@ func Test_1024Write(t *testing.T) {
 			t.Errorf("Read count is not match (want: %d, got: %d)", len(body), n)
 		}
 
-		wantBuffer := &bytes.Buffer{}
-		if _, err := sendPacket(wantBuffer, 0, []byte(body)); err != nil {
-			t.Errorf("Making packet was failed: %v", err)
-		}
-
 		if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
 			t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
 		}
@@ -384,29 +406,939 @@ func Test_1025Write(t *testing.T) {
 		t.Errorf("Making test body was failed: %v", err)
 	}
 
-	rxbuf.Write([]byte{0, 0, 0, 1, 0, 1})
-	rxbuf.Write([]byte{0, 0, 0, 1, 0, 2})
+	seq := kuda.txSeq
+	bytesBody := []byte(body)
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	_1stBody := bytesBody[:1024]
+	if _, err := sendPacket(wantBuffer, CRC32, flagNext, seq, _1stBody); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
+	_2ndBody := bytesBody[1024:1025]
+	if _, err := sendPacket(wantBuffer, CRC32, 0, seq+1, _2ndBody); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq+1))
 
-	if n, err := kuda.Write([]byte(body)); err != nil {
+	if n, err := kuda.Write(bytesBody); err != nil {
 		t.Errorf("Write was failed: %v", err)
 	} else {
 		if n != len(body) {
 			t.Errorf("Read count is not match (want: %d, got: %d)", len(body), n)
 		}
 
-		wantBuffer := &bytes.Buffer{}
-		bytesBody := []byte(body)
-		_1stBody := bytesBody[:1024]
-		if _, err := sendPacket(wantBuffer, 1, _1stBody); err != nil {
-			t.Errorf("Making packet was failed: %v", err)
+		if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+			t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
 		}
-		_2ndBody := bytesBody[1024:1025]
-		if _, err := sendPacket(wantBuffer, 0, _2ndBody); err != nil {
-			t.Errorf("Making packet was failed: %v", err)
+	}
+}
+
+func TestRead_checksumError(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := "test"
+	rxbuf.Write(synFrame(CRC32, 1))
+	corrupted := &bytes.Buffer{}
+	if _, err := sendPacket(corrupted, CRC32, 0, 1, []byte(body)); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+	corrupted.Bytes()[headerSize] ^= 0xFF
+	rxbuf.Write(corrupted.Bytes())
+
+	if _, err := sendPacket(rxbuf, CRC32, 0, 1, []byte(body)); err != nil {
+		t.Errorf("Making packet was failed: %v", err)
+	}
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else {
+		if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
 		}
 
-		if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
-			t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+		expectedReply := synACKFrame(CRC32, 1)
+		expectedReply = append(expectedReply, nakFrame(CRC32, 0)...)
+		expectedReply = append(expectedReply, ackFrame(CRC32, 1)...)
+		if !bytes.Equal(txbuf.Bytes(), expectedReply) {
+			t.Errorf("NAK/ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedReply, txbuf.Bytes())
+		}
+	}
+}
+
+func TestWrite_retransmitOnNAK(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		Checksum: CRC16,
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := "test"
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC16, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC16, seq))
+	sendPacket(wantBuffer, CRC16, 0, seq, []byte(body))
+	// a NAK of another frame doesn't count
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, nakFrame(CRC16, seq+7), nakFrame(CRC16, seq-1))
+	sendPacket(wantBuffer, CRC16, 0, seq, []byte(body))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC16, seq))
+
+	if _, err := kuda.Write([]byte(body)); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	} else if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestWrite_giveUpAfterRetries(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	seq := kuda.txSeq
+	sent := len(synFrame(CRC32, seq))
+	replyAfter(txbuf, sent, rxbuf, synACKFrame(CRC32, seq))
+	frame := &bytes.Buffer{}
+	sendPacket(frame, CRC32, 0, seq, []byte("test"))
+	for i := 0; i < 3; i++ {
+		sent += frame.Len()
+		replyAfter(txbuf, sent, rxbuf, nakFrame(CRC32, seq-1))
+	}
+
+	_, err = kuda.Write([]byte("test"))
+	for _, want := range []error{errNAK, ErrFraming} {
+		if !errors.Is(err, want) {
+			t.Errorf("Write error is not match\nwant: %v\ngot:  %v", want, err)
+		}
+	}
+	// the peer has answered every frame
+	if errors.Is(err, ErrNoResponse) {
+		t.Errorf("Write error matches %v: %v", ErrNoResponse, err)
+	}
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Errorf("Write error is not RetryError: %v", err)
+	} else if retryErr.Attempts != 3 {
+		t.Errorf("Attempts is not match (want: %d, got: %d)", 3, retryErr.Attempts)
+	}
+	if kuda.negotiated {
+		t.Errorf("Session is kept after the peer stopped answering")
+	}
+}
+
+func TestWrite_noResponse(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			ACKTimeout:  10 * time.Millisecond,
+			Backoff:     time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	seq := kuda.txSeq
+	replyAfter(txbuf, len(synFrame(CRC32, seq)), rxbuf, synACKFrame(CRC32, seq))
+
+	_, err = kuda.Write([]byte("test"))
+	for _, want := range []error{ErrTimeout, ErrNoResponse} {
+		if !errors.Is(err, want) {
+			t.Errorf("Write error is not match\nwant: %v\ngot:  %v", want, err)
+		}
+	}
+	if errors.Is(err, ErrFraming) {
+		t.Errorf("Write error matches %v: %v", ErrFraming, err)
+	}
+}
+
+func TestWrite_staleNAK(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		Retry: RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	// NAKs arriving while the link is idle
+	seq := kuda.txSeq
+	for i := 0; i < 4; i++ {
+		rxbuf.Write(nakFrame(CRC32, seq-1))
+	}
+	for len(kuda.acks) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, []byte("hello"))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
+
+	if _, err := kuda.Write([]byte("hello")); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	}
+	if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	// check value of CRC-16/CCITT-FALSE
+	if got := crc16([]byte("123456789")); got != 0x29B1 {
+		t.Errorf("crc16 is not match (want: %04X, got: %04X)", 0x29B1, got)
+	}
+}
+
+func TestRead_duplicate(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	bodies := []string{"first", "second"}
+	rxbuf.Write(synFrame(CRC32, 5))
+	sendPacket(rxbuf, CRC32, 0, 5, []byte(bodies[0]))
+	sendPacket(rxbuf, CRC32, 0, 5, []byte(bodies[0]))
+	sendPacket(rxbuf, CRC32, 0, 6, []byte(bodies[1]))
+
+	for _, body := range bodies {
+		if packet, err := kuda.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		} else if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+		}
+	}
+
+	expectedReply := append(synACKFrame(CRC32, 5), ackFrame(CRC32, 5)...)
+	expectedReply = append(append(expectedReply, ackFrame(CRC32, 5)...), ackFrame(CRC32, 6)...)
+	if !bytes.Equal(txbuf.Bytes(), expectedReply) {
+		t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedReply, txbuf.Bytes())
+	}
+}
+
+func TestWrite_retransmitOnTimeout(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		Retry: RetryPolicy{
+			ACKTimeout: 200 * time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := "test"
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, []byte(body))
+	// a late ACK of the previous frame must be ignored
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq-1))
+	sendPacket(wantBuffer, CRC32, 0, seq, []byte(body))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
+
+	if _, err := kuda.Write([]byte(body)); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	} else if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestRead_resync(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	bodies := []string{"first", "second"}
+	garbage := []byte("[ 12.3456] g_serial: ttyGS0 K")
+	rxbuf.Write(garbage)
+	rxbuf.Write(synFrame(CRC32, 1))
+	sendPacket(rxbuf, CRC32, 0, 1, []byte(bodies[0]))
+	rxbuf.Write(frameMagic[:1])
+	sendPacket(rxbuf, CRC32, 0, 2, []byte(bodies[1]))
+
+	for _, body := range bodies {
+		if packet, err := kuda.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		} else if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+		}
+	}
+
+	want := uint64(len(garbage) + 1)
+	if got := kuda.Stats().DiscardedBytes; got != want {
+		t.Errorf("Discarded bytes is not match (want: %d, got: %d)", want, got)
+	}
+}
+
+func TestRead_frameTooLarge(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		MaxFrameSize: 16,
+	}
+	reported := make(chan error, 4)
+	kuda.OnError = func(err error) {
+		reported <- err
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := "test"
+	rxbuf.Write(synFrame(CRC32, 1))
+	sendPacket(rxbuf, CRC32, 0, 1, bytes.Repeat([]byte{'a'}, 17))
+	// noise which looks like a header of a huge frame
+	rxbuf.Write([]byte{0x4B, 0x44, 0xFF, 0xFF, 0xFF, 0xFF, 0x00, 0x01, 0x02, 0x03, 0x04})
+	// the frame was rejected, so it is sent again
+	sendPacket(rxbuf, CRC32, 0, 1, []byte(body))
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != body {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+	}
+
+	if got := kuda.Stats().OversizedFrames; got != 2 {
+		t.Errorf("Oversized frames is not match (want: %d, got: %d)", 2, got)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-reported; !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("Reported error is not match\nwant: %v\ngot:  %v", ErrFrameTooLarge, err)
+		}
+	}
+}
+
+func TestRead_messageTooLarge(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Mode: &serial.Mode{
+			BaudRate: 115200,
+		},
+		MaxMessageSize: 8,
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := "test"
+	rxbuf.Write(synFrame(CRC32, 1))
+	sendPacket(rxbuf, CRC32, flagNext, 1, []byte("123456"))
+	sendPacket(rxbuf, CRC32, flagNext, 2, []byte("123456"))
+	sendPacket(rxbuf, CRC32, 0, 3, []byte("123456"))
+	sendPacket(rxbuf, CRC32, 0, 4, []byte(body))
+
+	if _, err := kuda.ReadPacket(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Read error is not match\nwant: %v\ngot:  %v", ErrMessageTooLarge, err)
+	}
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != body {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+	}
+}
+
+func newLinkedSerialFunc() func() {
+	a := &testutil.SafeBuffer{}
+	b := &testutil.SafeBuffer{}
+	t := openSerial
+	openSerial = func(portname string, mode *serial.Mode) (serial.Port, error) {
+		if portname == "COM1" {
+			return &DummyPort{InnerRxBuffer: a, InnerTxBuffer: b}, nil
+		}
+		return &DummyPort{InnerRxBuffer: b, InnerTxBuffer: a}, nil
+	}
+	return func() {
+		openSerial = t
+	}
+}
+
+func windowFrame(checksum Checksum, flags byte, seq uint32, window uint16) []byte {
+	buf := &bytes.Buffer{}
+	sendPacket(buf, checksum, flags, seq, binary.BigEndian.AppendUint16(nil, window))
+	return buf.Bytes()
+}
+
+// synFrame starts a session at seq with a window of 1.
+func synFrame(checksum Checksum, seq uint32) []byte {
+	return windowFrame(checksum, flagSYN, seq, 1)
+}
+
+// synACKFrame accepts a session at seq with a window of 1.
+func synACKFrame(checksum Checksum, seq uint32) []byte {
+	return windowFrame(checksum, flagACK|flagSYN, seq, 1)
+}
+
+// replyAfter writes replies to rxbuf once the link has sent the given
+// number of bytes, like a peer answering the frames.
+func replyAfter(txbuf *testutil.SafeBuffer, sent int, rxbuf io.Writer, replies ...[]byte) {
+	go func() {
+		for len(txbuf.Bytes()) < sent {
+			time.Sleep(time.Millisecond)
+		}
+		for _, reply := range replies {
+			rxbuf.Write(reply)
+		}
+	}()
+}
+
+func TestWrite_window(t *testing.T) {
+	for _, tt := range []struct {
+		txWindow, rxWindow, want int
+	}{
+		{4, 8, 4},
+		{8, 3, 3},
+		{4, 0, 1},
+	} {
+		restore := newLinkedSerialFunc()
+		sender := &Kuda{PortName: "COM1", WriteSize: 16, Window: tt.txWindow}
+		receiver := &Kuda{PortName: "COM2", Window: tt.rxWindow}
+		if err := sender.Open(); err != nil {
+			t.Errorf("kuda.Open was failed: %v", err)
+		}
+		if err := receiver.Open(); err != nil {
+			t.Errorf("kuda.Open was failed: %v", err)
+		}
+
+		body, err := testutil.MakeRandomStr(1000)
+		if err != nil {
+			t.Errorf("Making test body was failed: %v", err)
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := sender.Write([]byte(body))
+			errc <- err
+		}()
+
+		if packet, err := receiver.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		} else if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Write was failed: %v", err)
+		}
+
+		if sender.txWindow != tt.want || receiver.rxWindow != tt.want {
+			t.Errorf("Window is not match (want: %d, got: %d / %d)", tt.want, sender.txWindow, receiver.rxWindow)
+		}
+
+		sender.Close()
+		receiver.Close()
+		restore()
+	}
+}
+
+func TestWrite_peerReopened(t *testing.T) {
+	a, b := Pipe()
+	a.WriteSize, a.Window = 4, 4
+	b.Window = 4
+	if err := a.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer a.Close()
+	if err := b.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+
+	body := "0123456789ABCDEF"
+	for i, window := range []int{4, 1} {
+		if i > 0 {
+			// the peer starts over with a smaller window
+			b.Close()
+			b.Window = window
+			if err := b.Open(); err != nil {
+				t.Fatalf("kuda.Open was failed: %v", err)
+			}
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := a.Write([]byte(body))
+			errc <- err
+		}()
+		if packet, err := b.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		} else if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("Write was failed: %v", err)
+		}
+		if a.txWindow != window {
+			t.Errorf("Window is not match (want: %d, got: %d)", window, a.txWindow)
+		}
+	}
+	b.Close()
+}
+
+func TestWrite_lateSYNACK(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Retry: RetryPolicy{
+			ACKTimeout: 100 * time.Millisecond,
+			Backoff:    time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := []byte("test")
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	wantBuffer.Write(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, body)
+	// the late answer to the first SYN has the sequence number of the
+	// data frame, which has been lost
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, body)
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
+
+	if _, err := kuda.Write(body); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	}
+	if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestWrite_windowGoBackN(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName:  "COM1",
+		WriteSize: 4,
+		Window:    4,
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := []byte("0123456789ABCDEF")
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(windowFrame(CRC32, flagSYN, seq, 4))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, windowFrame(CRC32, flagACK|flagSYN, seq, 4))
+	for i, flags := range []byte{flagNext, flagNext, flagNext, 0} {
+		sendPacket(wantBuffer, CRC32, flags, seq+uint32(i), body[i*4:i*4+4])
+	}
+	// the third frame was corrupted
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq+1), nakFrame(CRC32, seq+1))
+	sendPacket(wantBuffer, CRC32, flagNext, seq+2, body[8:12])
+	sendPacket(wantBuffer, CRC32, 0, seq+3, body[12:16])
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq+3))
+
+	if _, err := kuda.Write(body); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	}
+	if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestRead_windowOutOfOrder(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Window:   4,
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	rxbuf.Write(windowFrame(CRC32, flagSYN, 10, 4))
+	sendPacket(rxbuf, CRC32, flagNext, 10, []byte("01"))
+	sendPacket(rxbuf, CRC32, 0, 12, []byte("45")) // 11 was lost
+	sendPacket(rxbuf, CRC32, flagNext, 10, []byte("01"))
+	sendPacket(rxbuf, CRC32, flagNext, 11, []byte("23"))
+	sendPacket(rxbuf, CRC32, 0, 12, []byte("45"))
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != "012345" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "012345", packet.String())
+	}
+
+	expectedReply := windowFrame(CRC32, flagACK|flagSYN, 10, 4)
+	for _, seq := range []uint32{10, 10, 10, 11, 12} {
+		expectedReply = append(expectedReply, ackFrame(CRC32, seq)...)
+	}
+	if !bytes.Equal(txbuf.Bytes(), expectedReply) {
+		t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedReply, txbuf.Bytes())
+	}
+}
+
+func TestRead_queueFull(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName:  "COM1",
+		QueueSize: 1,
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	rxbuf.Write(synFrame(CRC32, 1))
+	sendPacket(rxbuf, CRC32, 0, 1, []byte("first"))
+	sendPacket(rxbuf, CRC32, 0, 2, []byte("second"))
+
+	// the second message isn't acknowledged while the first one is queued
+	expectedReply := append(synACKFrame(CRC32, 1), ackFrame(CRC32, 1)...)
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(txbuf.Bytes(), expectedReply) {
+		t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedReply, txbuf.Bytes())
+	}
+
+	// the peer sends it again after the first one has been read
+	for _, body := range []string{"first", "second"} {
+		if packet, err := kuda.ReadPacket(); err != nil {
+			t.Errorf("Read was failed: %v", err)
+		} else if packet.String() != body {
+			t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+		}
+		if body == "first" {
+			sendPacket(rxbuf, CRC32, 0, 2, []byte("second"))
 		}
 	}
+
+	expectedReply = append(expectedReply, ackFrame(CRC32, 2)...)
+	if !bytes.Equal(txbuf.Bytes(), expectedReply) {
+		t.Errorf("ACK reply is not correct format:\nwant: %v\ngot:  %v", expectedReply, txbuf.Bytes())
+	}
+}
+
+func TestRead_withoutSession(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	// a data frame before a SYN, e.g. from a peer which hasn't noticed
+	// that the port was opened again
+	sendPacket(rxbuf, CRC32, 0, 7, []byte("lost"))
+	rxbuf.Write(synFrame(CRC32, 7))
+	sendPacket(rxbuf, CRC32, 0, 7, []byte("test"))
+	// a frame out of the window doesn't start a new session either
+	sendPacket(rxbuf, CRC32, 0, 100, []byte("lost"))
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != "test" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "test", packet.String())
+	}
+
+	expectedReply := &bytes.Buffer{}
+	sendPacket(expectedReply, CRC32, flagNAK|flagSYN, 0, nil)
+	expectedReply.Write(synACKFrame(CRC32, 7))
+	expectedReply.Write(ackFrame(CRC32, 7))
+	sendPacket(expectedReply, CRC32, flagNAK|flagSYN, 7, nil)
+	for len(txbuf.Bytes()) < expectedReply.Len() {
+		time.Sleep(time.Millisecond)
+	}
+	if !bytes.Equal(txbuf.Bytes(), expectedReply.Bytes()) {
+		t.Errorf("Reply is not correct format:\nwant: %v\ngot:  %v", expectedReply.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestRead_synDropsPartialMessage(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	// the sender gave up in the middle of a message and started over
+	rxbuf.Write(synFrame(CRC32, 1))
+	sendPacket(rxbuf, CRC32, flagNext, 1, []byte("partial "))
+	rxbuf.Write(synFrame(CRC32, 2))
+	sendPacket(rxbuf, CRC32, 0, 2, []byte("test"))
+
+	if packet, err := kuda.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != "test" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "test", packet.String())
+	}
+}
+
+func TestWrite_resync(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+		Retry: RetryPolicy{
+			Backoff: time.Millisecond,
+		},
+	}
+	err := kuda.Open()
+	defer kuda.Close()
+	if err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+
+	body := []byte("test")
+	seq := kuda.txSeq
+	wantBuffer := bytes.NewBuffer(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, body)
+	// the peer has been opened again and lost the session
+	resync := &bytes.Buffer{}
+	sendPacket(resync, CRC32, flagNAK|flagSYN, 0, nil)
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, resync.Bytes())
+	wantBuffer.Write(synFrame(CRC32, seq))
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, synACKFrame(CRC32, seq))
+	sendPacket(wantBuffer, CRC32, 0, seq, body)
+	replyAfter(txbuf, wantBuffer.Len(), rxbuf, ackFrame(CRC32, seq))
+
+	if _, err := kuda.Write(body); err != nil {
+		t.Errorf("Write was failed: %v", err)
+	}
+	if !bytes.Equal(txbuf.Bytes(), wantBuffer.Bytes()) {
+		t.Errorf("Write packet is not correct format:\nwant: %v\ngot:  %v", wantBuffer.Bytes(), txbuf.Bytes())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	kuda := &Kuda{
+		Mode: &serial.Mode{
+			BaudRate: 9600,
+			Parity:   serial.EvenParity,
+		},
+		WriteSize: 1024,
+		Retry: RetryPolicy{
+			Backoff:    100 * time.Millisecond,
+			MaxBackoff: 500 * time.Millisecond,
+		},
+		txWindow: 1,
+	}
+
+	// 11 bits per byte at 9600 baud
+	frameSize := headerSize + 1024 + CRC32.size()
+	wantTimeout := 1*time.Second + time.Duration(frameSize)*11*time.Second/9600
+	if got := kuda.ackTimeout(); got != wantTimeout {
+		t.Errorf("ACK timeout is not match (want: %v, got: %v)", wantTimeout, got)
+	}
+
+	for retry, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 500 * time.Millisecond,
+		9: 500 * time.Millisecond,
+	} {
+		if got := kuda.backoff(retry); got != want {
+			t.Errorf("Backoff of retry %d is not match (want: %v, got: %v)", retry, want, got)
+		}
+	}
+}
+
+func TestReadPacket_closed(t *testing.T) {
+	a, b := Pipe()
+	if _, err := a.ReadPacket(); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("ReadPacket error before Open is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+
+	if err := a.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	if err := b.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer b.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.ReadPacket()
+		errc <- err
+	}()
+	a.Close()
+	if err := <-errc; !errors.Is(err, ErrPortClosed) {
+		t.Errorf("ReadPacket error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	if _, err := a.Write([]byte("test")); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Write error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+}
+
+func TestWrite_closed(t *testing.T) {
+	rxbuf := &testutil.SafeBuffer{}
+	txbuf := &testutil.SafeBuffer{}
+	defer newOpenSerialFunc(rxbuf, txbuf)()
+	kuda := &Kuda{
+		PortName: "COM1",
+	}
+	if err := kuda.Open(); err != nil {
+		t.Errorf("kuda.Open was failed: %v", err)
+	}
+	kuda.Close()
+
+	// the transport isn't asked whether it has been closed
+	if _, err := kuda.Write([]byte("test")); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Write error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	if len(txbuf.Bytes()) != 0 {
+		t.Errorf("Frames were written after Close: %v", txbuf.Bytes())
+	}
+}
+
+func TestReopen_failed(t *testing.T) {
+	a, b := Pipe()
+	dial := a.Dialer
+	dialed := 0
+	a.Dialer = func() (Transport, error) {
+		if dialed++; dialed > 1 {
+			return nil, errors.New("device is gone")
+		}
+		return dial()
+	}
+	if err := a.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	if err := b.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer b.Close()
+
+	if err := a.Reopen(); err == nil {
+		t.Fatalf("Reopen didn't fail")
+	}
+	if _, err := a.Write([]byte("test")); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Write error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	if _, err := a.ReadPacket(); !errors.Is(err, ErrPortClosed) {
+		t.Errorf("ReadPacket error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("Close was failed: %v", err)
+	}
 }
@@ -0,0 +1,177 @@
+package kuda
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Pipe returns two links connected with each other in memory, so that a
+// Server and a Client can be tested without hardware:
+//
+//	server, client := kuda.Pipe()
+//	go (&kuda.Server{Port: server}).Serve(handler)
+//	response, err := (&kuda.Client{Dialer: client.Dialer}).Call(method, params)
+//
+// Like a serial cable, each end can be opened and closed repeatedly, and
+// bytes sent while the other end is closed are dropped when it is opened,
+// so a frame sent before the Server has opened its end is only received
+// after retransmission. Reads honour the read timeout the same way as
+// serial.Port does.
+func Pipe() (*Kuda, *Kuda) {
+	ab := newPipeBuffer()
+	ba := newPipeBuffer()
+
+	a := &Kuda{
+		PortName: "pipe-a",
+		Dialer: func() (Transport, error) {
+			return newPipeEnd(ba, ab), nil
+		},
+	}
+	b := &Kuda{
+		PortName: "pipe-b",
+		Dialer: func() (Transport, error) {
+			return newPipeEnd(ab, ba), nil
+		},
+	}
+
+	return a, b
+}
+
+// pipeBuffer holds the bytes in flight in one direction.
+type pipeBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+	// written is the number of bytes ever written.
+	written uint64
+	// arrived is closed and replaced whenever data is appended.
+	arrived chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{arrived: make(chan struct{})}
+}
+
+func (b *pipeBuffer) write(p []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	b.written += uint64(len(p))
+	close(b.arrived)
+	b.arrived = make(chan struct{})
+}
+
+// read copies buffered bytes into p. If there are none, it returns a
+// channel which is closed when some arrive.
+func (b *pipeBuffer) read(p []byte) (int, <-chan struct{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.data) == 0 {
+		return 0, b.arrived
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+// offset returns the position of the next byte to be written.
+func (b *pipeBuffer) offset() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.written
+}
+
+// reset drops the bytes written before offset.
+func (b *pipeBuffer) reset(offset uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	head := b.written - uint64(len(b.data))
+	if offset > head {
+		b.data = b.data[min(offset-head, uint64(len(b.data))):]
+	}
+}
+
+// pipeEnd is an opened end of a Pipe.
+type pipeEnd struct {
+	rx, tx  *pipeBuffer
+	timeout time.Duration
+	// opened is the offset of rx when this end was opened.
+	opened uint64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeEnd(rx, tx *pipeBuffer) *pipeEnd {
+	return &pipeEnd{
+		rx:      rx,
+		tx:      tx,
+		timeout: serial.NoTimeout,
+		opened:  rx.offset(),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (p *pipeEnd) Read(buf []byte) (int, error) {
+	var timer <-chan time.Time
+	if p.timeout != serial.NoTimeout {
+		timer = time.After(p.timeout)
+	}
+
+	for {
+		select {
+		case <-p.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+
+		n, arrived := p.rx.read(buf)
+		if n > 0 {
+			return n, nil
+		}
+
+		select {
+		case <-arrived:
+		case <-timer:
+			return 0, nil
+		case <-p.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (p *pipeEnd) Write(buf []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	p.tx.write(buf)
+	return len(buf), nil
+}
+
+func (p *pipeEnd) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *pipeEnd) SetReadTimeout(timeout time.Duration) error {
+	p.timeout = timeout
+	return nil
+}
+
+// ResetInputBuffer drops the bytes which were sent while this end was
+// closed.
+func (p *pipeEnd) ResetInputBuffer() error {
+	p.rx.reset(p.opened)
+	return nil
+}
+
+func (p *pipeEnd) ResetOutputBuffer() error {
+	return nil
+}
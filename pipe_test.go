@@ -0,0 +1,96 @@
+package kuda
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	if err := a.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer a.Close()
+	if err := b.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer b.Close()
+
+	end, _ := a.Dialer()
+	defer end.Close()
+	end.SetReadTimeout(50 * time.Millisecond)
+	start := time.Now()
+	if n, err := end.Read(make([]byte, 1)); n != 0 || err != nil {
+		t.Errorf("Read didn't time out (n: %d, err: %v)", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Read returned before the timeout: %v", elapsed)
+	}
+
+	body := "test"
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.Write([]byte(body))
+		errc <- err
+	}()
+
+	if packet, err := b.ReadPacket(); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if packet.String() != body {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", body, packet.String())
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Write was failed: %v", err)
+	}
+}
+
+// servePipe serves handler with server on one end of a Pipe. It returns
+// both ends after the server has opened its end, and the channel Serve
+// returns to.
+func servePipe(server *Server, handler http.Handler) (*Kuda, *Kuda, <-chan error) {
+	serverPort, clientPort := Pipe()
+
+	opened := make(chan struct{})
+	var once sync.Once
+	dial := serverPort.Dialer
+	serverPort.Dialer = func() (Transport, error) {
+		defer once.Do(func() { close(opened) })
+		return dial()
+	}
+
+	done := make(chan error, 1)
+	server.Port = serverPort
+	go func() {
+		done <- server.Serve(handler)
+	}()
+	<-opened
+
+	return serverPort, clientPort, done
+}
+
+func TestPipe_clientServer(t *testing.T) {
+	serverPort, clientPort, done := servePipe(&Server{}, echoHandler(t))
+
+	client := &Client{Dialer: clientPort.Dialer}
+	for _, param := range []string{"first", "second"} {
+		response, err := client.Call("Echo.Echo", []string{param})
+		if err != nil {
+			t.Fatalf("Call was failed: %v", err)
+		}
+
+		var result []string
+		if err := response.GetObject(&result); err != nil {
+			t.Errorf("GetObject was failed: %v", err)
+		} else if len(result) != 1 || result[0] != param {
+			t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{param}, result)
+		}
+	}
+
+	serverPort.Close()
+	if err := <-done; !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Serve error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+}
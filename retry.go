@@ -0,0 +1,136 @@
+package kuda
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// RetryPolicy controls how long a link waits for its peer and how often a
+// frame is sent again. Zero fields are replaced by defaults, and the ACK
+// timeout grows with the time it takes to transmit the frames in flight at
+// the baud rate of Mode, so that slow links don't time out spuriously.
+type RetryPolicy struct {
+	// ACKTimeout is how long Write waits for an ACK after sending frames.
+	// Zero means 1 second plus the transmission time of the frames.
+	ACKTimeout time.Duration
+	// InterByteTimeout is how long the rest of a partially received frame
+	// is waited for. Zero means 1 second.
+	InterByteTimeout time.Duration
+	// MaxAttempts is how many times a frame is sent before Write gives up.
+	// Zero means 4.
+	MaxAttempts int
+	// Backoff is the delay before the first retransmission. It doubles on
+	// every further attempt up to MaxBackoff. Zero means 100 milliseconds.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retransmissions. Zero means 2
+	// seconds.
+	MaxBackoff time.Duration
+}
+
+// RetryError is returned by Write when a frame wasn't acknowledged within
+// the attempts allowed by the RetryPolicy.
+type RetryError struct {
+	// Seq is the sequence number of the frame which wasn't acknowledged.
+	Seq uint32
+	// Attempts is how many times the frame was sent.
+	Attempts int
+	// ACKTimeout is the timeout which was applied to each attempt.
+	ACKTimeout time.Duration
+	// Elapsed is the time spent on the frame including backoff delays.
+	Elapsed time.Duration
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("frame %d was not acknowledged after %d attempts in %v (ACK timeout: %v): %v",
+		e.Seq, e.Attempts, e.Elapsed.Round(time.Millisecond), e.ACKTimeout, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports that the peer isn't responding, so that errors.Is matches
+// ErrNoResponse, if the last attempt timed out. A peer which keeps
+// rejecting frames with NAK is responding, and its error matches ErrFraming
+// only.
+func (e *RetryError) Is(target error) bool {
+	return target == ErrNoResponse && errors.Is(e.Err, ErrTimeout)
+}
+
+// transmitTime returns the time to transmit n bytes at the configured mode,
+// or zero if the link isn't a serial port with a known speed.
+func (kuda *Kuda) transmitTime(n int) time.Duration {
+	if kuda.Mode == nil {
+		return 0
+	}
+
+	baudRate := kuda.Mode.BaudRate
+	if baudRate == 0 {
+		baudRate = 9600
+	}
+	dataBits := kuda.Mode.DataBits
+	if dataBits == 0 {
+		dataBits = 8
+	}
+
+	// start bit + data bits + parity bit + stop bits, in half bits
+	halfBits := 2 + 2*dataBits
+	if kuda.Mode.Parity != serial.NoParity {
+		halfBits += 2
+	}
+	switch kuda.Mode.StopBits {
+	case serial.OnePointFiveStopBits:
+		halfBits += 3
+	case serial.TwoStopBits:
+		halfBits += 4
+	default:
+		halfBits += 2
+	}
+
+	return time.Duration(n*halfBits) * time.Second / time.Duration(2*baudRate)
+}
+
+func (kuda *Kuda) ackTimeout() time.Duration {
+	if kuda.Retry.ACKTimeout > 0 {
+		return kuda.Retry.ACKTimeout
+	}
+
+	frameSize := headerSize + kuda.WriteSize + kuda.Checksum.size()
+	return 1*time.Second + kuda.transmitTime(kuda.txWindow*frameSize)
+}
+
+func (kuda *Kuda) interByteTimeout() time.Duration {
+	if kuda.Retry.InterByteTimeout > 0 {
+		return kuda.Retry.InterByteTimeout
+	}
+	return 1 * time.Second
+}
+
+func (kuda *Kuda) maxAttempts() int {
+	if kuda.Retry.MaxAttempts > 0 {
+		return kuda.Retry.MaxAttempts
+	}
+	return 4
+}
+
+// backoff returns the delay before the given retransmission (1, 2, ...).
+func (kuda *Kuda) backoff(retry int) time.Duration {
+	delay := kuda.Retry.Backoff
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := kuda.Retry.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = 2 * time.Second
+	}
+
+	for i := 1; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
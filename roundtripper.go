@@ -0,0 +1,117 @@
+package kuda
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// RoundTripper is an http.RoundTripper which sends requests over a link to
+// a Server, so that code built on http.Client works over the serial cable:
+//
+//	client := &http.Client{
+//		Transport: &kuda.RoundTripper{
+//			Port: &kuda.Kuda{
+//				PortName: "COM2",
+//				Mode:     &serial.Mode{BaudRate: 115200},
+//			},
+//		},
+//	}
+//	resp, err := client.Get("http://device/status")
+//
+// Requests and responses travel in envelopes carrying the method, the path,
+// the headers and the status, so any http.Handler can serve them. The host
+// of the URL is only passed on as the Host header. The link is opened by
+// the first request and kept open. Requests may be sent from many
+// goroutines at once, and each response is passed to its request.
+type RoundTripper struct {
+	// Port holds the settings of the link and must be set. It is copied
+	// whenever the link is opened.
+	Port *Kuda
+
+	mutex sync.Mutex
+	conn  *clientConn
+}
+
+var _ http.RoundTripper = (*RoundTripper)(nil)
+
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("[client] reading request body was failed: %w", err)
+		}
+	}
+
+	if rt.Port == nil {
+		return nil, fmt.Errorf("[client] RoundTripper has no Port")
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	id := strconv.FormatInt(lastID.Add(1), 10)
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Host", host)
+	header.Set(idHeader, id)
+	message := requestEnvelope(method, req.URL.RequestURI(), header, body)
+
+	result, err := rt.connection().roundTrip(req.Context(), message, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	result.resp.Request = req
+	return result.resp, nil
+}
+
+// CloseIdleConnections closes the link. The next request opens it again.
+func (rt *RoundTripper) CloseIdleConnections() {
+	rt.mutex.Lock()
+	conn := rt.conn
+	rt.conn = nil
+	rt.mutex.Unlock()
+
+	if conn != nil {
+		conn.close()
+	}
+}
+
+func (rt *RoundTripper) connection() *clientConn {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	if rt.conn == nil {
+		rt.conn = &clientConn{newPort: rt.Port.clone, decode: decodeHTTPResponse}
+	}
+	return rt.conn
+}
+
+// decodeHTTPResponse decodes a response envelope for a RoundTripper.
+func decodeHTTPResponse(packet *bytes.Buffer) ([]string, callResult, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(packet), nil)
+	if err != nil {
+		return nil, callResult{}, fmt.Errorf("reading envelope was failed: %w", err)
+	}
+
+	var keys []string
+	if id := resp.Header.Get(idHeader); id != "" {
+		keys = []string{id}
+	}
+	return keys, callResult{resp: resp}, nil
+}
@@ -0,0 +1,111 @@
+package kuda
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRoundTripper(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "device" {
+			t.Errorf("Host is not match\nwant: %v\ngot:  %v", "device", r.Host)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"query":%q}`, r.URL.Query().Get("q"))
+	})
+	mux.HandleFunc("POST /items", func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		w.Header().Set("Location", "/items/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	})
+	serverPort, clientPort, _ := servePipe(&Server{MaxConcurrent: 4}, mux)
+	defer serverPort.Close()
+
+	rt := &RoundTripper{Port: clientPort}
+	defer rt.CloseIdleConnections()
+	client := &http.Client{Transport: rt}
+
+	resp, err := client.Get("http://device/status?q=test")
+	if err != nil {
+		t.Fatalf("Get was failed: %v", err)
+	}
+	if body := readResponse(t, resp); resp.StatusCode != http.StatusOK || body != `{"query":"test"}` {
+		t.Errorf("Response is not match\nwant: %v %v\ngot:  %v %v", http.StatusOK, `{"query":"test"}`, resp.StatusCode, body)
+	}
+
+	// an object without an id is a REST body, not a notification
+	resp, err = client.Post("http://device/items", "application/json", strings.NewReader(`{"name":"item"}`))
+	if err != nil {
+		t.Fatalf("Post was failed: %v", err)
+	}
+	if body := readResponse(t, resp); resp.StatusCode != http.StatusCreated || body != `{"name":"item"}` {
+		t.Errorf("Response is not match\nwant: %v %v\ngot:  %v %v", http.StatusCreated, `{"name":"item"}`, resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Location"); got != "/items/1" {
+		t.Errorf("Location is not match\nwant: %v\ngot:  %v", "/items/1", got)
+	}
+
+	resp, err = client.Get("http://device/missing")
+	if err != nil {
+		t.Fatalf("Get was failed: %v", err)
+	}
+	readResponse(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Status is not match\nwant: %v\ngot:  %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestRoundTripper_concurrent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	serverPort, clientPort, _ := servePipe(&Server{MaxConcurrent: 4}, handler)
+	defer serverPort.Close()
+
+	rt := &RoundTripper{Port: clientPort}
+	defer rt.CloseIdleConnections()
+	client := &http.Client{Transport: rt}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/call-%d", i)
+			resp, err := client.Get("http://device" + path)
+			if err != nil {
+				t.Errorf("Get was failed: %v", err)
+				return
+			}
+			if body := readResponse(t, resp); body != path {
+				t.Errorf("Body is not match\nwant: %v\ngot:  %v", path, body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundTripper_withoutPort(t *testing.T) {
+	client := &http.Client{Transport: &RoundTripper{}}
+	if _, err := client.Get("http://device/status"); err == nil {
+		t.Errorf("Get didn't fail")
+	}
+}
+
+// readResponse reads and closes the body of a response.
+func readResponse(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Reading response was failed: %v", err)
+	}
+	return string(body)
+}
@@ -0,0 +1,43 @@
+package kuda
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JsonRpcError is the error object of a response. Client calls return it
+// wrapped when the server answers with an error, so it can be taken out
+// with errors.As, and the standard errors below can be told apart with
+// errors.Is.
+type JsonRpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Data is additional information defined by the server.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// The errors defined by the JSON-RPC 2.0 specification. errors.Is matches
+// them by code, regardless of the message.
+var (
+	ErrParse          = &JsonRpcError{Code: -32700, Message: "Parse error"}
+	ErrInvalidRequest = &JsonRpcError{Code: -32600, Message: "Invalid Request"}
+	ErrMethodNotFound = &JsonRpcError{Code: -32601, Message: "Method not found"}
+	ErrInvalidParams  = &JsonRpcError{Code: -32602, Message: "Invalid params"}
+	ErrInternal       = &JsonRpcError{Code: -32603, Message: "Internal error"}
+)
+
+func (e *JsonRpcError) Error() string {
+	return fmt.Sprintf("%d : %s", e.Code, e.Message)
+}
+
+// Is reports whether target is a JsonRpcError with the same code.
+func (e *JsonRpcError) Is(target error) bool {
+	t, ok := target.(*JsonRpcError)
+	return ok && t.Code == e.Code
+}
+
+// isSet reports whether the response carried an error. Some servers send
+// the code 0 with a message.
+func (e *JsonRpcError) isSet() bool {
+	return e.Code != 0 || e.Message != "" || len(e.Data) > 0
+}
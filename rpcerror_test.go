@@ -0,0 +1,60 @@
+package kuda
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClient_errorResponse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params JsonRpcError    `json:"params"`
+			Id     json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(readBody(t, r), &req)
+
+		// answer with the error object given as params
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":   req.Params,
+			"id":      req.Id,
+			"jsonrpc": "2.0",
+		})
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		rpcErr JsonRpcError
+		is     error
+	}{
+		{JsonRpcError{Code: -32601, Message: "no such method"}, ErrMethodNotFound},
+		{JsonRpcError{Code: -32602, Message: "Invalid params", Data: json.RawMessage(`{"field":"Add"}`)}, ErrInvalidParams},
+		{JsonRpcError{Code: 0, Message: "application error"}, nil},
+	}
+	for _, test := range tests {
+		_, err := client.Call("Echo.Fail", test.rpcErr)
+
+		var rpcErr *JsonRpcError
+		if !errors.As(err, &rpcErr) {
+			t.Errorf("Error is not a JsonRpcError: %v", err)
+			continue
+		}
+		if rpcErr.Code != test.rpcErr.Code || rpcErr.Message != test.rpcErr.Message || string(rpcErr.Data) != string(test.rpcErr.Data) {
+			t.Errorf("Error is not match\nwant: %+v\ngot:  %+v", test.rpcErr, *rpcErr)
+		}
+		if test.is != nil && !errors.Is(err, test.is) {
+			t.Errorf("errors.Is(%v, %v) is false", err, test.is)
+		}
+		if errors.Is(err, ErrInternal) {
+			t.Errorf("errors.Is(%v, %v) is true", err, ErrInternal)
+		}
+	}
+}
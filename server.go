@@ -1,81 +1,575 @@
 package kuda
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
 
 	"go.bug.st/serial"
 )
 
-func Serve(portname string, handler http.Handler) error {
+// Option configures the link opened by Serve.
+type Option func(*Kuda)
+
+// WithMode sets the serial mode, e.g. for 57600 8E1:
+//
+//	kuda.WithMode(&serial.Mode{
+//		BaudRate: 57600,
+//		DataBits: 8,
+//		Parity:   serial.EvenParity,
+//		StopBits: serial.OneStopBit,
+//	})
+func WithMode(mode *serial.Mode) Option {
+	return func(kuda *Kuda) {
+		kuda.Mode = mode
+	}
+}
+
+// WithWriteSize sets the size of the frames the link sends.
+func WithWriteSize(size int) Option {
+	return func(kuda *Kuda) {
+		kuda.WriteSize = size
+	}
+}
+
+// WithRetry sets the timeouts and retransmissions of the link.
+func WithRetry(policy RetryPolicy) Option {
+	return func(kuda *Kuda) {
+		kuda.Retry = policy
+	}
+}
+
+// WithReadTimeout sets how long the link waits for a message.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(kuda *Kuda) {
+		kuda.ReadTimeout = timeout
+	}
+}
+
+// Serve serves handler on the serial port portname at 115200 baud unless
+// the options say otherwise. Other settings of the link can be changed by
+// custom options, or by using Server directly.
+func Serve(portname string, handler http.Handler, options ...Option) error {
 	port := &Kuda{
 		PortName: portname,
 		Mode: &serial.Mode{
 			BaudRate: 115200,
 		},
 	}
+	for _, option := range options {
+		option(port)
+	}
 
-	server := &Server{port}
+	server := &Server{Port: port}
 	return server.Serve(handler)
 }
 
+// response buffers what a handler writes and sends it as one message when
+// the handler returns. Flush sends the buffered part right away as the
+// beginning of the message, which then holds the link until it is finished.
+//
+// If the request came in an envelope, the response is put in one with the
+// status and the headers. Otherwise they are dropped.
 type response struct {
-	writer io.Writer
-	err    error
+	// port is where the response is sent. If nil, the response is only
+	// buffered, e.g. as an entry of a batch, and Flush does nothing.
+	port *Kuda
+	// request is the envelope of the request, or nil if it had none.
+	request *http.Request
+	status  int
+	header  http.Header
+	buf     bytes.Buffer
+	// streaming is set once a part of the message has been sent.
+	streaming bool
+	err       error
 }
 
+var _ http.Flusher = (*response)(nil)
+
 func (r *response) Header() http.Header {
-	header := make(map[string][]string, 0)
-	return header
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
 }
 
 func (r *response) Write(data []byte) (int, error) {
-	n, err := r.writer.Write(data)
-	if err != nil {
-		r.err = err
+	if r.err != nil {
+		return 0, r.err
 	}
-	return n, nil
+	return r.buf.Write(data)
 }
 
 func (r *response) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
 }
 
-func (r *response) Err() error {
+// head returns the envelope of the response, or nil if the request had
+// none. A negative length leaves the Content-Length out.
+func (r *response) head(length int) []byte {
+	if r.request == nil {
+		return nil
+	}
+
+	header := r.Header()
+	if header.Get("Content-Type") == "" && r.buf.Len() > 0 {
+		header.Set("Content-Type", http.DetectContentType(r.buf.Bytes()))
+	}
+	if id := r.request.Header.Get(idHeader); id != "" {
+		header.Set(idHeader, id)
+	}
+	return responseHead(max(r.status, http.StatusOK), header, length)
+}
+
+// Flush sends what has been written so far as continuation frames of the
+// response.
+func (r *response) Flush() {
+	if r.port == nil || r.err != nil || r.buf.Len() == 0 {
+		return
+	}
+
+	part := r.buf.Bytes()
+	if !r.streaming {
+		if r.err = r.port.beginMessage(); r.err != nil {
+			return
+		}
+		r.streaming = true
+		part = append(r.head(-1), part...)
+	}
+	_, r.err = r.port.writePart(part, false)
+	r.buf.Reset()
+}
+
+// finish sends the rest of the response and ends the message.
+func (r *response) finish() error {
+	if r.port == nil {
+		return r.err
+	}
+
+	if r.streaming {
+		if r.err != nil {
+			// the peer drops the part it has received
+			r.port.abortMessage()
+			return r.err
+		}
+		defer r.port.endMessage()
+		_, r.err = r.port.writePart(r.buf.Bytes(), true)
+		return r.err
+	}
+
+	if r.err == nil && (r.buf.Len() > 0 || r.request != nil) {
+		_, r.err = r.port.Write(append(r.head(r.buf.Len()), r.buf.Bytes()...))
+	}
 	return r.err
 }
 
+// abort drops the response, e.g. after the handler panicked. If a part of
+// it has been flushed, the message is broken off, so that the peer drops it
+// instead of taking it for a complete response.
+func (r *response) abort() {
+	r.buf.Reset()
+	if r.streaming {
+		r.streaming = false
+		r.port.abortMessage()
+	}
+}
+
 type Server struct {
-	port *Kuda
+	// Port is the link requests are served on. Its Dialer allows serving
+	// over transports other than a serial port.
+	Port *Kuda
+	// MaxConcurrent is the number of requests handled at the same time.
+	// Each response is sent when its handler returns, so responses may be
+	// sent in a different order than the requests arrived. Zero or one
+	// handles requests one by one.
+	MaxConcurrent int
+	// Reopen makes Serve reopen the port when it fails, e.g. because the
+	// device was reset, instead of returning. Reopening is tried as often
+	// as the RetryPolicy of the port allows. Closing the port with Close
+	// still ends Serve.
+	Reopen bool
+	// OnError is called with every error Serve runs into. fatal tells
+	// whether Serve returns it. If nil, the errors are logged. Unless
+	// Port.OnError is set, Serve sets it to pass on the errors of dropped
+	// frames, e.g. ErrFrameTooLarge.
+	OnError func(err error, fatal bool)
+
+	// mutex guards the fields below and replacing the port.
+	mutex sync.Mutex
+	// quit is closed by Shutdown and Close.
+	quit     chan struct{}
+	quitOnce sync.Once
+	// done is closed when Serve returns.
+	done chan struct{}
+}
+
+// ErrServerClosed is returned by Serve after Shutdown or Close.
+var ErrServerClosed = errors.New("server was closed")
+
+// quitChan returns the channel closed by Shutdown and Close. s.mutex must
+// be held.
+func (s *Server) quitChan() chan struct{} {
+	if s.quit == nil {
+		s.quit = make(chan struct{})
+	}
+	return s.quit
+}
+
+// stop makes Serve stop reading requests and returns the channel closed
+// when it has returned, or nil if it isn't serving.
+func (s *Server) stop() chan struct{} {
+	quit := s.quitChan()
+	s.quitOnce.Do(func() {
+		close(quit)
+	})
+	return s.done
+}
+
+// Shutdown stops the server gracefully: Serve stops reading requests, the
+// handlers which are running finish and send their responses, and the port
+// is closed. Shutdown waits for that until ctx is done, and Serve returns
+// ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	done := s.stop()
+	s.mutex.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the port at once, so that responses of running handlers
+// are lost. Serve returns ErrServerClosed.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stop() == nil {
+		return nil
+	}
+	return s.Port.Close()
 }
 
 func (s *Server) Serve(handler http.Handler) error {
-	if err := s.port.Open(); err != nil {
+	s.mutex.Lock()
+	quit := s.quitChan()
+	select {
+	case <-quit:
+		s.mutex.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	if s.Port.OnError == nil {
+		s.Port.OnError = func(err error) {
+			s.report(fmt.Errorf("receiving request was failed: %w", err), false)
+		}
+	}
+	if err := s.Port.Open(); err != nil {
+		s.mutex.Unlock()
 		return fmt.Errorf("[server] opening serial port was failed: %w", err)
 	}
-	defer s.port.Close()
+	done := make(chan struct{})
+	s.done = done
+	s.mutex.Unlock()
+
+	defer close(done)
+	defer s.Port.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, max(s.MaxConcurrent, 1))
 
 	for {
-		packet, err := s.port.ReadPacket()
-		if err != nil {
-			return fmt.Errorf("[server] reading request was failed: %w", err)
+		packet, err := s.Port.readPacket(quit)
+		select {
+		case <-quit:
+			return ErrServerClosed
+		default:
+		}
+		if errors.Is(err, ErrTimeout) {
+			// no request while idle
+			continue
 		}
+		if err != nil && isRecoverable(err) {
+			// The receiver has already skipped the bad frames and
+			// finds the next one by itself.
+			s.report(fmt.Errorf("reading request was failed: %w", err), false)
+			continue
+		}
+		if err != nil && s.Reopen && isPortError(err) && !errors.Is(err, errClosedByClose) {
+			s.report(fmt.Errorf("reading request was failed: %w", err), false)
 
-		req, err := http.NewRequest("POST", "", packet)
+			// handlers can't be writing while the port is replaced
+			wg.Wait()
+			if err := s.reopen(quit); err != nil {
+				if errors.Is(err, ErrServerClosed) {
+					return err
+				}
+				s.report(err, true)
+				return fmt.Errorf("[server] %w", err)
+			}
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("[server] creating a request was failed: %w", err)
+			err = fmt.Errorf("reading request was failed: %w", err)
+			s.report(err, true)
+			return fmt.Errorf("[server] %w", err)
 		}
 
-		w := &response{
-			s.port,
-			nil,
+		if s.MaxConcurrent <= 1 {
+			s.serve(handler, packet.Bytes())
+			continue
 		}
 
-		handler.ServeHTTP(w, req)
+		select {
+		case slots <- struct{}{}:
+		case <-quit:
+			return ErrServerClosed
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.serve(handler, packet.Bytes())
+		}()
+	}
+}
 
-		if w.Err() != nil {
-			log.Println("[server] ServeHTTP error:", w.Err())
+// isRecoverable reports whether a read error affects a single message
+// only, so that Serve can go on.
+func isRecoverable(err error) bool {
+	return errors.Is(err, ErrFraming) || errors.Is(err, ErrMessageTooLarge)
+}
+
+// reopen reopens the port, waiting between attempts like Write does
+// between retransmissions.
+func (s *Server) reopen(quit chan struct{}) error {
+	for attempt := 1; ; attempt++ {
+		s.mutex.Lock()
+		select {
+		case <-quit:
+			s.mutex.Unlock()
+			return ErrServerClosed
+		default:
+		}
+		err := s.Port.Reopen()
+		s.mutex.Unlock()
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.Port.maxAttempts() {
+			return fmt.Errorf("reopening serial port was failed: %w", err)
+		}
+
+		s.report(err, false)
+		time.Sleep(s.Port.backoff(attempt))
+	}
+}
+
+// report passes an error to OnError. Otherwise it is logged, unless it is
+// fatal and returned by Serve anyway.
+func (s *Server) report(err error, fatal bool) {
+	if s.OnError != nil {
+		s.OnError(err, fatal)
+		return
+	}
+	if !fatal {
+		log.Println("[server]", err)
+	}
+}
+
+// serve handles a message, which is either a request or a batch and may
+// come in an envelope.
+func (s *Server) serve(handler http.Handler, message []byte) {
+	envelope, body, err := openRequest(message)
+	if err != nil {
+		s.report(err, false)
+		s.send(&http.Request{}, http.StatusBadRequest, nil)
+		return
+	}
+
+	if envelope == nil && isBatch(body) || envelope != nil && envelope.Header.Get(batchHeader) != "" {
+		s.serveBatch(handler, envelope, body)
+		return
+	}
+
+	w := &response{request: envelope}
+	if expectsResponse(envelope, body) {
+		w.port = s.Port
+	}
+
+	err = serveRequest(handler, w, envelope, body)
+	if err != nil {
+		s.report(fmt.Errorf("ServeHTTP error: %w", err), false)
+	}
+	if _, panicked := err.(*panicError); panicked {
+		w.abort()
+		if w.port != nil {
+			s.send(envelope, http.StatusInternalServerError, errorResponse(ErrInternal, requestID(body)))
+		}
+		return
+	}
+
+	if err := w.finish(); err != nil {
+		s.report(fmt.Errorf("ServeHTTP error: %w", err), false)
+	}
+}
+
+// serveBatch handles the requests of a batch one after another and sends
+// their responses together as one message.
+func (s *Server) serveBatch(handler http.Handler, envelope *http.Request, message []byte) {
+	var requests []json.RawMessage
+	if err := json.Unmarshal(message, &requests); err != nil {
+		s.send(envelope, http.StatusOK, errorResponse(ErrParse, nil))
+		return
+	}
+	if len(requests) == 0 {
+		s.send(envelope, http.StatusOK, errorResponse(ErrInvalidRequest, nil))
+		return
+	}
+
+	var resps [][]byte
+	for _, request := range requests {
+		w := &response{}
+		err := serveRequest(handler, w, envelope, request)
+		if _, ok := err.(*panicError); ok {
+			w.abort()
+			w.Write(errorResponse(ErrInternal, requestID(request)))
+		}
+		if err != nil {
+			s.report(fmt.Errorf("ServeHTTP error: %w", err), false)
+		}
+
+		// notifications have no response
+		if resp := bytes.TrimSpace(w.buf.Bytes()); len(resp) > 0 && !isNotification(request) {
+			resps = append(resps, resp)
 		}
 	}
+	if len(resps) == 0 {
+		return
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteByte('[')
+	out.Write(bytes.Join(resps, []byte{','}))
+	out.WriteByte(']')
+	s.send(envelope, http.StatusOK, out.Bytes())
+}
+
+// send sends a response made up by the server itself, in an envelope if
+// the request had one.
+func (s *Server) send(envelope *http.Request, status int, message []byte) {
+	w := &response{port: s.Port, request: envelope, status: status}
+	if len(message) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(message)
+	if err := w.finish(); err != nil {
+		s.report(fmt.Errorf("ServeHTTP error: %w", err), false)
+	}
+}
+
+// expectsResponse reports whether a request is to be answered. A request in
+// an envelope is answered if it has an id header, whatever its body is.
+func expectsResponse(envelope *http.Request, body []byte) bool {
+	if envelope != nil {
+		return envelope.Header.Get(idHeader) != ""
+	}
+	return !isNotification(body)
+}
+
+// isNotification reports whether a request has no id, so that it must not
+// be answered.
+func isNotification(request []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(request, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["id"]
+	return !ok
+}
+
+// errorResponse encodes an error response to the request id. A nil id is
+// sent as null.
+func errorResponse(rpcErr *JsonRpcError, id json.RawMessage) []byte {
+	out := &bytes.Buffer{}
+	json.NewEncoder(out).Encode(map[string]any{
+		"jsonrpc": "2.0",
+		"error":   rpcErr,
+		"id":      id,
+	})
+	return out.Bytes()
+}
+
+// requestID returns the raw id of a request, or nil if it can't be read.
+func requestID(request []byte) json.RawMessage {
+	var req struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(request, &req); err != nil {
+		return nil
+	}
+	return req.Id
+}
+
+// panicError is a panic of a handler recovered by the server.
+type panicError struct {
+	value any
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v\n%s", e.value, e.stack)
+}
+
+// newRequest makes the request passed to the handler. It takes the method,
+// URL and headers from the envelope, or is a bare POST without one.
+func newRequest(envelope *http.Request, body []byte) (*http.Request, error) {
+	if envelope == nil {
+		return http.NewRequest("POST", "", bytes.NewReader(body))
+	}
+
+	req := envelope.Clone(context.Background())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	if req.Header.Get("Content-Length") != "" {
+		// the entries of a batch are shorter
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return req, nil
+}
+
+// serveRequest calls the handler. If it panics, the panic is returned as
+// *panicError, so that the server stays up.
+func serveRequest(handler http.Handler, w *response, envelope *http.Request, body []byte) (err error) {
+	req, err := newRequest(envelope, body)
+	if err != nil {
+		return fmt.Errorf("[server] creating a request was failed: %w", err)
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = &panicError{v, debug.Stack()}
+		}
+	}()
+
+	handler.ServeHTTP(w, req)
+	return nil
 }
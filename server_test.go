@@ -0,0 +1,416 @@
+package kuda
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bamchoh/kuda/internal/testutil"
+	"go.bug.st/serial"
+)
+
+func TestServer_notification(t *testing.T) {
+	handled := make(chan struct{}, 2)
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a handler which answers notifications anyway
+		echo.ServeHTTP(w, r)
+		handled <- struct{}{}
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+	if err := clientPort.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer clientPort.Close()
+
+	for _, message := range []string{
+		`{"method":"Echo.Echo","params":["single"],"jsonrpc":"2.0"}`,
+		`[{"method":"Echo.Echo","params":["batch"],"jsonrpc":"2.0"}]`,
+	} {
+		if _, err := clientPort.Write([]byte(message)); err != nil {
+			t.Fatalf("Write was failed: %v", err)
+		}
+		<-handled
+	}
+
+	clientPort.ReadTimeout = 100 * time.Millisecond
+	if packet, err := clientPort.ReadPacket(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Notification was answered (packet: %v, err: %v)", packet, err)
+	}
+}
+
+func TestServe_options(t *testing.T) {
+	a := &testutil.SafeBuffer{}
+	b := &testutil.SafeBuffer{}
+	modes := make(chan *serial.Mode, 2)
+	ports := make(chan serial.Port, 2)
+	defer func(f func(string, *serial.Mode) (serial.Port, error)) { openSerial = f }(openSerial)
+	openSerial = func(portname string, mode *serial.Mode) (serial.Port, error) {
+		port := &DummyPort{InnerRxBuffer: a, InnerTxBuffer: b}
+		if portname == "COM2" {
+			port = &DummyPort{InnerRxBuffer: b, InnerTxBuffer: a}
+		}
+		modes <- mode
+		ports <- port
+		return port, nil
+	}
+
+	mode := &serial.Mode{
+		BaudRate: 57600,
+		DataBits: 8,
+		Parity:   serial.EvenParity,
+		StopBits: serial.OneStopBit,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve("COM1", echoHandler(t), WithMode(mode), WithWriteSize(8))
+	}()
+	serverPort := <-ports
+	if got := <-modes; got != mode {
+		t.Errorf("Mode of Serve is not match\nwant: %+v\ngot:  %+v", mode, got)
+	}
+
+	client := &Client{
+		Port: &Kuda{
+			PortName:  "COM2",
+			Mode:      mode,
+			WriteSize: 8,
+		},
+	}
+	callEcho(t, client, "longer than a frame")
+	if got := <-modes; got != mode {
+		t.Errorf("Mode of Client is not match\nwant: %+v\ngot:  %+v", mode, got)
+	}
+	if client.Port.port != nil {
+		t.Errorf("Port of Client was opened instead of a copy")
+	}
+
+	serverPort.Close()
+	if err := <-done; !errors.Is(err, ErrPortClosed) {
+		t.Errorf("Serve error is not match\nwant: %v\ngot:  %v", ErrPortClosed, err)
+	}
+}
+
+// serverErrors records the errors reported by a Server.
+type serverErrors struct {
+	mutex  sync.Mutex
+	errors []error
+}
+
+func (e *serverErrors) report(err error, fatal bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.errors = append(e.errors, err)
+}
+
+func (e *serverErrors) has(target error) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, err := range e.errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServer_recoverable(t *testing.T) {
+	reported := &serverErrors{}
+	serverPort, clientPort := Pipe()
+	serverPort.MaxMessageSize = 128
+	server := &Server{Port: serverPort, OnError: reported.report}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(echoHandler(t))
+	}()
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Notify("Echo.Echo", []string{strings.Repeat("x", 128)}); err != nil {
+		t.Fatalf("Notify was failed: %v", err)
+	}
+	callEcho(t, client, "after a too large message")
+
+	if !reported.has(ErrMessageTooLarge) {
+		t.Errorf("%v was not reported: %v", ErrMessageTooLarge, reported.errors)
+	}
+	select {
+	case err := <-done:
+		t.Errorf("Serve returned: %v", err)
+	default:
+	}
+}
+
+func TestServer_frameTooLarge(t *testing.T) {
+	reported := &serverErrors{}
+	serverPort, clientPort := Pipe()
+	serverPort.MaxFrameSize = 64
+	opened := make(chan struct{})
+	dial := serverPort.Dialer
+	serverPort.Dialer = func() (Transport, error) {
+		defer close(opened)
+		return dial()
+	}
+	server := &Server{Port: serverPort, OnError: reported.report}
+	go server.Serve(echoHandler(t))
+	<-opened
+	defer serverPort.Close()
+
+	clientPort.Retry = RetryPolicy{MaxAttempts: 1, ACKTimeout: 50 * time.Millisecond}
+	client := &Client{Port: clientPort}
+	if err := client.Notify("Echo.Echo", []string{strings.Repeat("x", 64)}); err == nil {
+		t.Errorf("Notify didn't fail")
+	}
+	if !reported.has(ErrFrameTooLarge) {
+		t.Errorf("%v was not reported: %v", ErrFrameTooLarge, reported.errors)
+	}
+}
+
+func TestServer_Reopen(t *testing.T) {
+	reported := &serverErrors{}
+	transports := make(chan Transport, 2)
+	serverPort, clientPort := Pipe()
+	server := &Server{Port: serverPort, Reopen: true, OnError: reported.report}
+	dial := serverPort.Dialer
+	serverPort.Dialer = func() (Transport, error) {
+		transport, err := dial()
+		transports <- transport
+		return transport, err
+	}
+	go server.Serve(echoHandler(t))
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	// the device is reset
+	(<-transports).Close()
+	<-transports
+
+	callEcho(t, client, "after reopening")
+	if !reported.has(ErrPortClosed) {
+		t.Errorf("%v was not reported: %v", ErrPortClosed, reported.errors)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		echo.ServeHTTP(w, r)
+	})
+	server := &Server{MaxConcurrent: 2}
+	_, clientPort, done := servePipe(server, handler)
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	called := make(chan struct{})
+	go func() {
+		defer close(called)
+		callEcho(t, client, "in flight")
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the handler finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-called
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown was failed: %v", err)
+	}
+	if err := <-done; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve error is not match\nwant: %v\ngot:  %v", ErrServerClosed, err)
+	}
+	if err := server.Serve(handler); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve error after Shutdown is not match\nwant: %v\ngot:  %v", ErrServerClosed, err)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	server := &Server{}
+	_, _, done := servePipe(server, echoHandler(t))
+
+	if err := server.Close(); err != nil {
+		t.Errorf("Close was failed: %v", err)
+	}
+	if err := <-done; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve error is not match\nwant: %v\ngot:  %v", ErrServerClosed, err)
+	}
+}
+
+func TestServer_panic(t *testing.T) {
+	echo := echoHandler(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBody(t, r)
+		if bytes.Contains(body, []byte(`"panic"`)) {
+			w.Write([]byte("partial"))
+			panic("handler is broken")
+		}
+		echo.ServeHTTP(w, withBody(r, body))
+	})
+	reported := &serverErrors{}
+	server := &Server{OnError: reported.report}
+	serverPort, clientPort, _ := servePipe(server, handler)
+	defer serverPort.Close()
+
+	client := &Client{Dialer: clientPort.Dialer}
+	if err := client.Dial(); err != nil {
+		t.Fatalf("Dial was failed: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Call("Echo.Echo", []string{"panic"}); !errors.Is(err, ErrInternal) {
+		t.Errorf("Call error is not match\nwant: %v\ngot:  %v", ErrInternal, err)
+	}
+
+	calls := []*BatchCall{
+		{Method: "Echo.Echo", Params: []string{"panic"}},
+		{Method: "Echo.Echo", Params: []string{"batch"}},
+	}
+	if err := client.Batch(calls); err != nil {
+		t.Fatalf("Batch was failed: %v", err)
+	}
+	if !errors.Is(calls[0].Err, ErrInternal) {
+		t.Errorf("Batch error is not match\nwant: %v\ngot:  %v", ErrInternal, calls[0].Err)
+	}
+	if calls[1].Err != nil {
+		t.Errorf("Call in batch was failed: %v", calls[1].Err)
+	}
+
+	callEcho(t, client, "after panic")
+
+	reported.mutex.Lock()
+	defer reported.mutex.Unlock()
+	if len(reported.errors) != 2 || !strings.Contains(reported.errors[0].Error(), "handler is broken") ||
+		!strings.Contains(reported.errors[0].Error(), "goroutine") {
+		t.Errorf("Panic with stack was not reported: %v", reported.errors)
+	}
+}
+
+func TestServer_panicAfterFlush(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"partial`))
+		w.(http.Flusher).Flush()
+		panic("handler is broken")
+	})
+	server := &Server{OnError: (&serverErrors{}).report}
+	serverPort, clientPort, _ := servePipe(server, handler)
+	defer serverPort.Close()
+
+	// the flushed part is dropped, so the client gets the error only
+	client := &Client{Dialer: clientPort.Dialer}
+	if _, err := client.Call("Echo.Echo", []string{"panic"}); !errors.Is(err, ErrInternal) {
+		t.Errorf("Call error is not match\nwant: %v\ngot:  %v", ErrInternal, err)
+	}
+}
+
+func TestServer_bufferedResponse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Id json.RawMessage `json:"id"`
+		}
+		json.Unmarshal(readBody(t, r), &req)
+
+		// the response is written in pieces
+		fmt.Fprintf(w, `{"jsonrpc":"2.0",`)
+		fmt.Fprintf(w, `"result":["pieces"],"id":%s}`, req.Id)
+	})
+	serverPort, clientPort, _ := servePipe(&Server{}, handler)
+	defer serverPort.Close()
+
+	callEcho(t, &Client{Dialer: clientPort.Dialer}, "pieces")
+}
+
+// readFrame reads the next data frame from a raw end of a Pipe and
+// acknowledges it. A SYN is accepted with a window of 1.
+func readFrame(t *testing.T, peer Transport, rx *Kuda) *Packet {
+	t.Helper()
+
+	buf := make([]byte, 256)
+	peer.SetReadTimeout(time.Second)
+	for {
+		packet, err := rx.parse()
+		if err != nil {
+			t.Fatalf("parse was failed: %v", err)
+		}
+		if packet != nil && packet.flags&flagSYN != 0 {
+			peer.Write(windowFrame(CRC32, flagACK|flagSYN, packet.Seq, 1))
+			continue
+		}
+		if packet != nil {
+			sendPacket(peer, CRC32, flagACK, packet.Seq, nil)
+			return packet
+		}
+
+		n, err := peer.Read(buf)
+		if err != nil || n == 0 {
+			t.Fatalf("Read was failed (n: %d, err: %v)", n, err)
+		}
+		rx.rxBuffer.Write(buf[:n])
+	}
+}
+
+func TestResponse_Flush(t *testing.T) {
+	a, b := Pipe()
+	if err := a.Open(); err != nil {
+		t.Fatalf("kuda.Open was failed: %v", err)
+	}
+	defer a.Close()
+	peer, _ := b.Dialer()
+	defer peer.Close()
+	rx := &Kuda{MaxFrameSize: 1 << 20, rxBuffer: &bytes.Buffer{}}
+
+	release := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		w := &response{port: a}
+		w.Write([]byte("first "))
+		w.Flush()
+		<-release
+		w.Write([]byte("second"))
+		errc <- w.finish()
+	}()
+
+	// the flushed part arrives while the handler is still running
+	if packet := readFrame(t, peer, rx); string(packet.Data) != "first " || packet.Next == 0 {
+		t.Errorf("First frame is not match\nwant: %q (next)\ngot:  %q (next: %d)", "first ", packet.Data, packet.Next)
+	}
+	close(release)
+	if packet := readFrame(t, peer, rx); string(packet.Data) != "second" || packet.Next != 0 {
+		t.Errorf("Last frame is not match\nwant: %q (last)\ngot:  %q (next: %d)", "second", packet.Data, packet.Next)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("finish was failed: %v", err)
+	}
+}
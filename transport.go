@@ -0,0 +1,161 @@
+package kuda
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Transport is the byte stream a link runs over. serial.Port satisfies it.
+type Transport interface {
+	io.ReadWriteCloser
+
+	// SetReadTimeout sets the timeout of Read. When it expires, Read returns
+	// 0 bytes without error. serial.NoTimeout makes Read block until data
+	// arrives.
+	SetReadTimeout(t time.Duration) error
+}
+
+// bufferResetter is implemented by transports which can drop stale data,
+// like serial.Port.
+type bufferResetter interface {
+	ResetInputBuffer() error
+	ResetOutputBuffer() error
+}
+
+type deadliner interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// NewTransport adapts an io.ReadWriteCloser, such as a net.Conn, an os.File
+// of a PTY or a pipe, to Transport. If it supports read deadlines, these
+// implement the read timeout. Otherwise the stream is read in a goroutine.
+func NewTransport(rwc io.ReadWriteCloser) Transport {
+	if t, ok := rwc.(Transport); ok {
+		return t
+	}
+
+	if conn, ok := rwc.(deadliner); ok && conn.SetReadDeadline(time.Time{}) == nil {
+		return &deadlineTransport{conn: conn, timeout: serial.NoTimeout}
+	}
+
+	t := &streamTransport{
+		rwc:     rwc,
+		timeout: serial.NoTimeout,
+		chunks:  make(chan []byte, 16),
+	}
+	go t.receive()
+	return t
+}
+
+// NetDialer returns a dialer for Kuda.Dialer and Client.Dialer which
+// connects to address on the named network, e.g. a ser2net endpoint or a
+// terminal server.
+func NetDialer(network, address string) func() (Transport, error) {
+	return func() (Transport, error) {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return NewTransport(conn), nil
+	}
+}
+
+type deadlineTransport struct {
+	conn    deadliner
+	timeout time.Duration
+}
+
+func (t *deadlineTransport) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if t.timeout != serial.NoTimeout {
+		deadline = time.Now().Add(t.timeout)
+	}
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	n, err := t.conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (t *deadlineTransport) Write(p []byte) (int, error) {
+	return t.conn.Write(p)
+}
+
+func (t *deadlineTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *deadlineTransport) SetReadTimeout(timeout time.Duration) error {
+	t.timeout = timeout
+	return nil
+}
+
+type streamTransport struct {
+	rwc     io.ReadWriteCloser
+	timeout time.Duration
+
+	chunks chan []byte
+	rest   []byte
+	err    error
+}
+
+func (t *streamTransport) receive() {
+	for {
+		buf := make([]byte, 2048)
+		n, err := t.rwc.Read(buf)
+		if n > 0 {
+			t.chunks <- buf[:n]
+		}
+		if err != nil {
+			t.err = err
+			close(t.chunks)
+			return
+		}
+	}
+}
+
+func (t *streamTransport) Read(p []byte) (int, error) {
+	if len(t.rest) == 0 {
+		var timer <-chan time.Time
+		if t.timeout != serial.NoTimeout {
+			timer = time.After(t.timeout)
+		}
+
+		select {
+		case chunk, ok := <-t.chunks:
+			if !ok {
+				return 0, t.err
+			}
+			t.rest = chunk
+		case <-timer:
+			return 0, nil
+		}
+	}
+
+	n := copy(p, t.rest)
+	t.rest = t.rest[n:]
+	return n, nil
+}
+
+func (t *streamTransport) Write(p []byte) (int, error) {
+	return t.rwc.Write(p)
+}
+
+func (t *streamTransport) Close() error {
+	return t.rwc.Close()
+}
+
+func (t *streamTransport) SetReadTimeout(timeout time.Duration) error {
+	t.timeout = timeout
+	return nil
+}
@@ -0,0 +1,135 @@
+package kuda
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type pipeReadWriteCloser struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeReadWriteCloser) Close() error {
+	p.PipeWriter.Close()
+	return p.PipeReader.Close()
+}
+
+func testTransportTimeout(t *testing.T, transport Transport, peer io.Writer) {
+	transport.SetReadTimeout(50 * time.Millisecond)
+
+	buf := make([]byte, 16)
+	if n, err := transport.Read(buf); n != 0 || err != nil {
+		t.Errorf("Read didn't time out (n: %d, err: %v)", n, err)
+	}
+
+	go peer.Write([]byte("test"))
+
+	transport.SetReadTimeout(1 * time.Second)
+	if n, err := transport.Read(buf); err != nil {
+		t.Errorf("Read was failed: %v", err)
+	} else if string(buf[:n]) != "test" {
+		t.Errorf("Read content is not match\nwant: %s\ngot:  %s", "test", buf[:n])
+	}
+}
+
+func TestNewTransport_stream(t *testing.T) {
+	r, peer := io.Pipe()
+	_, w := io.Pipe()
+	transport := NewTransport(pipeReadWriteCloser{r, w})
+	defer transport.Close()
+
+	if _, ok := transport.(*streamTransport); !ok {
+		t.Errorf("Transport type is not match: %T", transport)
+	}
+	testTransportTimeout(t, transport, peer)
+}
+
+func TestNewTransport_conn(t *testing.T) {
+	conn, peer := net.Pipe()
+	transport := NewTransport(conn)
+	defer transport.Close()
+
+	if _, ok := transport.(*deadlineTransport); !ok {
+		t.Errorf("Transport type is not match: %T", transport)
+	}
+	testTransportTimeout(t, transport, peer)
+}
+
+func echoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Id     json.RawMessage `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Decoding request was failed: %v", err)
+		}
+
+		resp := &bytes.Buffer{}
+		json.NewEncoder(resp).Encode(map[string]any{
+			"result":  req.Params,
+			"id":      req.Id,
+			"jsonrpc": "2.0",
+		})
+		w.Write(resp.Bytes())
+	})
+}
+
+// readBody reads the body of a request handled by a test handler.
+func readBody(t *testing.T, r *http.Request) []byte {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Errorf("Reading request was failed: %v", err)
+	}
+	return body
+}
+
+// withBody returns r with body to be read again.
+func withBody(r *http.Request, body []byte) *http.Request {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return r
+}
+
+func TestClient_tcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen was failed: %v", err)
+	}
+	defer ln.Close()
+
+	conns := make(chan net.Conn, 1)
+	server := &Server{
+		Port: &Kuda{
+			Dialer: func() (Transport, error) {
+				conn, err := ln.Accept()
+				if err != nil {
+					return nil, err
+				}
+				conns <- conn
+				return NewTransport(conn), nil
+			},
+		},
+	}
+	go server.Serve(echoHandler(t))
+
+	client := Client{Dialer: NetDialer("tcp", ln.Addr().String())}
+	response, err := client.Call("Echo.Echo", []string{"hello"})
+	if err != nil {
+		t.Fatalf("Call was failed: %v", err)
+	}
+	(<-conns).Close()
+
+	var result []string
+	if err := response.GetObject(&result); err != nil {
+		t.Errorf("GetObject was failed: %v", err)
+	} else if len(result) != 1 || result[0] != "hello" {
+		t.Errorf("Result is not match\nwant: %v\ngot:  %v", []string{"hello"}, result)
+	}
+}